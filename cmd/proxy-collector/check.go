@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ConfigError lists every problem of a config. Each problem starts with
+// its location such as routes[0]:target_list[1].
+type ConfigError struct {
+	Problems []string
+}
+
+func (e *ConfigError) Error() string {
+	return strings.Join(e.Problems, "\n")
+}
+
+func (e *ConfigError) add(at string, format string, args ...interface{}) {
+	e.Problems = append(e.Problems, location(at, fmt.Sprintf(format, args...)))
+}
+
+// location joins the location at and s, at is empty at top level.
+func location(at, s string) string {
+	if at == "" {
+		return s
+	}
+	return at + ":" + s
+}
+
+var (
+	unmarshalerType  = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+	targetConfigType = reflect.TypeOf(TargetConfig{})
+)
+
+// fieldChecker checks config decoded from JSON with UseNumber against the
+// config types, so that every misspelled key and every value of wrong
+// type is reported with its location. encoding/json ignores the former
+// and stops at the first of the latter.
+type fieldChecker struct {
+	e *ConfigError
+	// invalid are the locations of values which could not be decoded.
+	invalid []string
+	// scalarStrings converts numbers and bools in maps of strings, such
+	// as labels, to strings. YAML and TOML type them unless quoted.
+	scalarStrings bool
+}
+
+// check reports the problems of v as t. It returns false when v can not
+// be decoded as t, otherwise the values which can not be decoded are
+// removed from v.
+func (c *fieldChecker) check(at string, v interface{}, t reflect.Type) bool {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if v == nil {
+		return true
+	}
+
+	m, isObject := v.(map[string]interface{})
+	switch {
+	case t == targetConfigType && isObject:
+		// TargetConfig is also written as url string.
+		return c.checkStruct(at, m, t)
+	case reflect.PtrTo(t).Implements(unmarshalerType):
+		return c.decode(at, v, t)
+	case t.Kind() == reflect.Struct && isObject:
+		return c.checkStruct(at, m, t)
+	case t.Kind() == reflect.Map && t.Elem().Kind() == reflect.String && isObject && c.scalarStrings:
+		for k, elem := range m {
+			switch elem := elem.(type) {
+			case json.Number:
+				m[k] = elem.String()
+			case bool:
+				m[k] = strconv.FormatBool(elem)
+			}
+		}
+		return c.decode(at, v, t)
+	case t.Kind() == reflect.Slice && isStruct(t.Elem()):
+		s, ok := v.([]interface{})
+		if !ok {
+			return c.decode(at, v, t)
+		}
+		for i, elem := range s {
+			if !c.check(fmt.Sprintf("%v[%d]", at, i), elem, t.Elem()) {
+				s[i] = map[string]interface{}{}
+			}
+		}
+		return true
+	default:
+		return c.decode(at, v, t)
+	}
+}
+
+func (c *fieldChecker) checkStruct(at string, m map[string]interface{}, t reflect.Type) bool {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	fields := jsonFields(t)
+	for _, k := range keys {
+		ft, ok := lookupField(fields, k)
+		if !ok {
+			c.e.add(at, "unknown field:%v", k)
+			continue
+		}
+		if !c.check(location(at, k), m[k], ft) {
+			delete(m, k)
+		}
+	}
+	return true
+}
+
+func (c *fieldChecker) decode(at string, v interface{}, t reflect.Type) bool {
+	b, err := json.Marshal(v)
+	if err == nil {
+		err = json.Unmarshal(b, reflect.New(t).Interface())
+	}
+	if err == nil {
+		return true
+	}
+
+	if te, ok := err.(*json.UnmarshalTypeError); ok {
+		c.e.add(fieldLocation(at, te.Field), "should be %v but got %v", te.Type, te.Value)
+	} else {
+		c.e.add(at, "%v", err)
+	}
+	c.invalid = append(c.invalid, at)
+	return false
+}
+
+// underInvalid reports whether problem is about a value below one which
+// could not be decoded, and so is caused by the missing value.
+func (c *fieldChecker) underInvalid(problem string) bool {
+	for _, at := range c.invalid {
+		if at != "" && strings.HasPrefix(problem, at+":") {
+			return true
+		}
+	}
+	return false
+}
+
+// fieldLocation joins at and field, a dotted path of keys and indexes
+// such as "0" or "labels.region".
+func fieldLocation(at, field string) string {
+	if field == "" {
+		return at
+	}
+	for _, f := range strings.Split(field, ".") {
+		if _, err := strconv.Atoi(f); err == nil {
+			at = fmt.Sprintf("%v[%v]", at, f)
+		} else {
+			at = location(at, f)
+		}
+	}
+	return at
+}
+
+func isStruct(t reflect.Type) bool {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t.Kind() == reflect.Struct
+}
+
+// jsonFields returns the type of each field of t by its JSON name,
+// including the fields of embedded structs.
+func jsonFields(t reflect.Type) map[string]reflect.Type {
+	fields := map[string]reflect.Type{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+		if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+			for n, ft := range jsonFields(f.Type) {
+				if _, ok := fields[n]; !ok {
+					fields[n] = ft
+				}
+			}
+			continue
+		}
+		if f.PkgPath != "" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		fields[name] = f.Type
+	}
+	return fields
+}
+
+// lookupField matches key like encoding/json, preferring an exact match
+// over a case-insensitive one.
+func lookupField(fields map[string]reflect.Type, key string) (reflect.Type, bool) {
+	if t, ok := fields[key]; ok {
+		return t, true
+	}
+	for n, t := range fields {
+		if strings.EqualFold(n, key) {
+			return t, true
+		}
+	}
+	return nil, false
+}
+
+// checkConfig writes every problem of the config at p to w and returns
+// the exit code, non-zero when there is a problem.
+func checkConfig(w io.Writer, p string, format string) int {
+	_, err := LoadConfigFormat(p, format)
+	if err == nil {
+		fmt.Fprintf(w, "%v:ok\n", p)
+		return 0
+	}
+
+	if e, ok := err.(*ConfigError); ok {
+		for _, problem := range e.Problems {
+			fmt.Fprintf(w, "%v:%v\n", p, problem)
+		}
+	} else {
+		fmt.Fprintf(w, "%v:%v\n", p, err)
+	}
+	return 1
+}
@@ -1,59 +1,705 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"net/http"
 	"net/url"
 	"os"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
 
 	"github.com/soh335/proxy-collector/proxy"
 )
 
 type Config struct {
-	TargetList   []string           `json:"target_list"`
-	BodyFallback proxy.BodyFallback `json:"body_fallback"`
+	GroupConfig
+	Routes []*RouteConfig `json:"routes"`
+	// GlobalMaxConcurrency bounds the outbound requests in flight across
+	// every route.
+	GlobalMaxConcurrency int `json:"global_max_concurrency"`
 }
 
-func (c *Config) validate() error {
+// GroupConfig is a target list and how to fan out to it. It is used at
+// top level and in each route.
+type GroupConfig struct {
+	TargetList       []*TargetConfig    `json:"target_list"`
+	BodyFallback     proxy.BodyFallback `json:"body_fallback"`
+	BodyBufferSize   int64              `json:"body_buffer_size"`
+	Timeout          Duration           `json:"timeout"`
+	PerTargetTimeout Duration           `json:"per_target_timeout"`
+	Timing           bool               `json:"timing"`
+	Headers          bool               `json:"headers"`
+	HeaderAllowList  []string           `json:"header_allow_list"`
+	HeaderDenyList   []string           `json:"header_deny_list"`
+	Order            string             `json:"order"`
+	Strategy         string             `json:"strategy"`
+	Diff             string             `json:"diff"`
+	DiffIgnorePaths  []string           `json:"diff_ignore_paths"`
+	Consensus        bool               `json:"consensus"`
+	HealthCheck      *HealthCheckConfig `json:"health_check"`
+	CircuitBreaker   *BreakerConfig     `json:"circuit_breaker"`
+	MaxConcurrency   int                `json:"max_concurrency"`
+	// Retry and RateLimit are used for targets without their own. Each
+	// target gets its own rate limit bucket.
+	Retry     *RetryConfig     `json:"retry"`
+	RateLimit *RateLimitConfig `json:"rate_limit"`
+}
+
+// HealthCheckConfig probes every target of the group in background.
+// Unhealthy is "request", "skip" or "report".
+type HealthCheckConfig struct {
+	Path           string   `json:"path"`
+	Interval       Duration `json:"interval"`
+	Timeout        Duration `json:"timeout"`
+	ExpectedStatus int      `json:"expected_status"`
+	Rise           int      `json:"rise"`
+	Fall           int      `json:"fall"`
+	Unhealthy      string   `json:"unhealthy"`
+}
+
+func (h *HealthCheckConfig) validate(e *ConfigError, at string) {
+	if h.Interval.Duration < 0 {
+		e.add(at, "interval must not be negative:%v", h.Interval)
+	}
+	if h.Timeout.Duration < 0 {
+		e.add(at, "timeout must not be negative:%v", h.Timeout)
+	}
+	if h.ExpectedStatus != 0 && (h.ExpectedStatus < 100 || h.ExpectedStatus > 599) {
+		e.add(at, "invalid expected_status:%v", h.ExpectedStatus)
+	}
+	if h.Rise < 0 {
+		e.add(at, "rise must not be negative:%v", h.Rise)
+	}
+	if h.Fall < 0 {
+		e.add(at, "fall must not be negative:%v", h.Fall)
+	}
+	if _, err := proxy.ParseUnhealthyAction(h.Unhealthy); err != nil {
+		e.add(at, "%v", err)
+	}
+}
+
+// BreakerConfig gives every target of the group its own circuit breaker.
+type BreakerConfig struct {
+	ConsecutiveFailures int      `json:"consecutive_failures"`
+	ErrorRate           float64  `json:"error_rate"`
+	MinRequests         int      `json:"min_requests"`
+	Window              Duration `json:"window"`
+	OpenTimeout         Duration `json:"open_timeout"`
+}
+
+func (b *BreakerConfig) validate(e *ConfigError, at string) {
+	if b.ConsecutiveFailures < 0 {
+		e.add(at, "consecutive_failures must not be negative:%v", b.ConsecutiveFailures)
+	}
+	if b.ErrorRate < 0 || b.ErrorRate > 1 {
+		e.add(at, "error_rate must be between 0 and 1:%v", b.ErrorRate)
+	}
+	if b.MinRequests < 0 {
+		e.add(at, "min_requests must not be negative:%v", b.MinRequests)
+	}
+	if b.Window.Duration < 0 {
+		e.add(at, "window must not be negative:%v", b.Window)
+	}
+	if b.OpenTimeout.Duration < 0 {
+		e.add(at, "open_timeout must not be negative:%v", b.OpenTimeout)
+	}
+}
+
+func (b *BreakerConfig) BreakerConfig() proxy.BreakerConfig {
+	return proxy.BreakerConfig{
+		ConsecutiveFailures: b.ConsecutiveFailures,
+		ErrorRate:           b.ErrorRate,
+		MinRequests:         b.MinRequests,
+		Window:              b.Window.Duration,
+		OpenTimeout:         b.OpenTimeout.Duration,
+	}
+}
+
+type RetryConfig struct {
+	MaxAttempts   int      `json:"max_attempts"`
+	StatusCodes   []int    `json:"status_codes"`
+	ErrorKinds    []string `json:"error_kinds"`
+	BaseDelay     Duration `json:"base_delay"`
+	MaxDelay      Duration `json:"max_delay"`
+	NonIdempotent bool     `json:"non_idempotent"`
+}
+
+func (r *RetryConfig) validate(e *ConfigError, at string) {
+	if r.MaxAttempts < 0 {
+		e.add(at, "max_attempts must not be negative:%v", r.MaxAttempts)
+	}
+	for _, code := range r.StatusCodes {
+		if code < 100 || code > 599 {
+			e.add(at, "invalid status code:%v", code)
+		}
+	}
+	for _, kind := range r.ErrorKinds {
+		if _, err := proxy.ParseErrorKind(kind); err != nil {
+			e.add(at, "%v", err)
+		}
+	}
+	if r.BaseDelay.Duration < 0 {
+		e.add(at, "base_delay must not be negative:%v", r.BaseDelay)
+	}
+	if r.MaxDelay.Duration < 0 {
+		e.add(at, "max_delay must not be negative:%v", r.MaxDelay)
+	}
+}
+
+func (r *RetryConfig) RetryPolicy() *proxy.RetryPolicy {
+	policy := &proxy.RetryPolicy{
+		MaxAttempts:   r.MaxAttempts,
+		StatusCodes:   r.StatusCodes,
+		BaseDelay:     r.BaseDelay.Duration,
+		MaxDelay:      r.MaxDelay.Duration,
+		NonIdempotent: r.NonIdempotent,
+	}
+	for _, kind := range r.ErrorKinds {
+		k, _ := proxy.ParseErrorKind(kind)
+		policy.ErrorKinds = append(policy.ErrorKinds, k)
+	}
+	return policy
+}
+
+// RateLimitConfig is a token bucket of Rate requests per second up to
+// Burst. Requests over the limit wait up to MaxWait.
+type RateLimitConfig struct {
+	Rate    float64  `json:"rate"`
+	Burst   int      `json:"burst"`
+	MaxWait Duration `json:"max_wait"`
+}
+
+func (r *RateLimitConfig) validate(e *ConfigError, at string) {
+	if r.Rate <= 0 {
+		e.add(at, "rate must be positive:%v", r.Rate)
+	}
+	if r.Burst < 0 {
+		e.add(at, "burst must not be negative:%v", r.Burst)
+	}
+	if r.MaxWait.Duration < 0 {
+		e.add(at, "max_wait must not be negative:%v", r.MaxWait)
+	}
+}
+
+func (r *RateLimitConfig) RateLimiter() *proxy.RateLimiter {
+	return proxy.NewRateLimiter(r.Rate, r.Burst, r.MaxWait.Duration)
+}
+
+func (h *HealthCheckConfig) HealthCheck() proxy.HealthCheck {
+	return proxy.HealthCheck{
+		Path:           h.Path,
+		Interval:       h.Interval.Duration,
+		Timeout:        h.Timeout.Duration,
+		ExpectedStatus: h.ExpectedStatus,
+		Rise:           h.Rise,
+		Fall:           h.Fall,
+	}
+}
+
+// TargetConfig is written either as url string or as object with url,
+// name and labels.
+type TargetConfig struct {
+	Name   string            `json:"name"`
+	URL    string            `json:"url"`
+	Labels map[string]string `json:"labels"`
+	// header values may contain ${env:NAME} and ${file:/path/to/secret}
+	SetHeaders    map[string]string `json:"set_headers"`
+	AddHeaders    map[string]string `json:"add_headers"`
+	RemoveHeaders []string          `json:"remove_headers"`
+	Rewrite       *RewriteConfig    `json:"rewrite"`
+	Retry         *RetryConfig      `json:"retry"`
+	RateLimit     *RateLimitConfig  `json:"rate_limit"`
+}
+
+type RewriteConfig struct {
+	StripPrefix string            `json:"strip_prefix"`
+	Regexp      string            `json:"regexp"`
+	Replacement string            `json:"replacement"`
+	AddPrefix   string            `json:"add_prefix"`
+	RemoveQuery []string          `json:"remove_query"`
+	AddQuery    map[string]string `json:"add_query"`
+}
+
+func (r *RewriteConfig) Rewrite() (*proxy.Rewrite, error) {
+	rewrite := &proxy.Rewrite{
+		StripPrefix: r.StripPrefix,
+		Replacement: r.Replacement,
+		AddPrefix:   r.AddPrefix,
+		RemoveQuery: r.RemoveQuery,
+	}
+	if r.Regexp != "" {
+		re, err := regexp.Compile(r.Regexp)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regexp:%v", err)
+		}
+		rewrite.Regexp = re
+	}
+	if len(r.AddQuery) > 0 {
+		rewrite.AddQuery = url.Values{}
+		for k, v := range r.AddQuery {
+			rewrite.AddQuery.Set(k, v)
+		}
+	}
+	return rewrite, nil
+}
+
+func (t *TargetConfig) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*t = TargetConfig{URL: s}
+		return nil
+	}
+
+	if b = bytes.TrimSpace(b); len(b) == 0 || b[0] != '{' {
+		return fmt.Errorf("target should be url string or object:%s", b)
+	}
+
+	type targetConfig TargetConfig
+	var v targetConfig
+	if err := json.Unmarshal(b, &v); err != nil {
+		return fmt.Errorf("target:%v", err)
+	}
+	*t = TargetConfig(v)
+	return nil
+}
+
+// RouteConfig sends requests whose path starts with Prefix or matches
+// Pattern to its own group.
+type RouteConfig struct {
+	Name    string `json:"name"`
+	Prefix  string `json:"prefix"`
+	Pattern string `json:"pattern"`
+	// RouteRateLimit bounds the requests to the route.
+	RouteRateLimit *RateLimitConfig `json:"route_rate_limit"`
+	GroupConfig
+}
+
+// Duration is time.Duration written as string such as "1.5s" in config.
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration should be string such as \"1s\":%s", b)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// validate adds every problem of c to e.
+func (c *Config) validate(e *ConfigError) {
+	if c.GlobalMaxConcurrency < 0 {
+		e.add("", "global_max_concurrency must not be negative:%v", c.GlobalMaxConcurrency)
+	}
+	if len(c.Routes) == 0 {
+		c.GroupConfig.validate(e, "")
+		return
+	}
+
+	if len(c.TargetList) > 0 {
+		e.add("", "target_list and routes can not be used together. add route with prefix \"/\" instead")
+	}
+	// the other group settings of top level are not used with routes either
+	gv := reflect.ValueOf(c.GroupConfig)
+	for i := 0; i < gv.NumField(); i++ {
+		f := gv.Type().Field(i)
+		if f.Name == "TargetList" || gv.Field(i).IsZero() {
+			continue
+		}
+		e.add("", "%v can not be used with routes, set it on each route", strings.Split(f.Tag.Get("json"), ",")[0])
+	}
+	names := map[string]bool{}
+	prefixes := map[string]bool{}
+	patterns := map[string]bool{}
+	for i, r := range c.Routes {
+		at := fmt.Sprintf("routes[%d]", i)
+		r.validate(e, at)
+		if r.Name != "" {
+			if names[r.Name] {
+				e.add(at, "duplicate name:%v", r.Name)
+			}
+			names[r.Name] = true
+		}
+		// a later route with the same prefix or pattern is never used.
+		if r.Prefix != "" {
+			if prefixes[r.Prefix] {
+				e.add(at, "duplicate prefix:%v", r.Prefix)
+			}
+			prefixes[r.Prefix] = true
+		}
+		if r.Pattern != "" {
+			if patterns[r.Pattern] {
+				e.add(at, "duplicate pattern:%v", r.Pattern)
+			}
+			patterns[r.Pattern] = true
+		}
+	}
+}
+
+func (r *RouteConfig) validate(e *ConfigError, at string) {
+	switch {
+	case r.Prefix == "" && r.Pattern == "":
+		e.add(at, "prefix or pattern is required")
+	case r.Prefix != "" && r.Pattern != "":
+		e.add(at, "prefix and pattern can not be used together")
+	case r.Pattern != "":
+		if _, err := regexp.Compile(r.Pattern); err != nil {
+			e.add(at, "invalid pattern:%v", err)
+		}
+	}
+	if r.RouteRateLimit != nil {
+		r.RouteRateLimit.validate(e, location(at, "route_rate_limit"))
+	}
+	r.GroupConfig.validate(e, at)
+}
+
+func (c *GroupConfig) validate(e *ConfigError, at string) {
 	if len(c.TargetList) <= 0 {
-		return fmt.Errorf("target_list is empty")
+		e.add(at, "target_list is empty")
+	}
+	names := map[string]bool{}
+	urls := map[string]bool{}
+	for i, t := range c.TargetList {
+		tat := location(at, fmt.Sprintf("target_list[%d]", i))
+		if t.URL == "" {
+			e.add(tat, "url is empty")
+		} else if _, err := proxy.ParseTargetURL(t.URL); err != nil {
+			e.add(tat, "%v", err)
+		}
+		if _, err := expandHeaders(t.SetHeaders); err != nil {
+			e.add(tat, "set_headers:%v", err)
+		}
+		if _, err := expandHeaders(t.AddHeaders); err != nil {
+			e.add(tat, "add_headers:%v", err)
+		}
+		if t.Rewrite != nil {
+			if _, err := t.Rewrite.Rewrite(); err != nil {
+				e.add(tat, "rewrite:%v", err)
+			}
+		}
+		if t.Retry != nil {
+			t.Retry.validate(e, location(tat, "retry"))
+		}
+		if t.RateLimit != nil {
+			t.RateLimit.validate(e, location(tat, "rate_limit"))
+		}
+		if t.Name != "" {
+			if names[t.Name] {
+				e.add(tat, "duplicate name:%v", t.Name)
+			}
+			names[t.Name] = true
+			continue
+		}
+		// items of the same url are told apart only by name.
+		if t.URL != "" {
+			if urls[t.URL] {
+				e.add(tat, "duplicate url:%v. give each a name to list it more than once", t.URL)
+			}
+			urls[t.URL] = true
+		}
 	}
 	switch c.BodyFallback {
 	case proxy.BodyFallbackNone, proxy.BodyFallbackJsonEncode:
 		break
 	default:
-		return fmt.Errorf("not support body fallback mode:%v", c.BodyFallback)
+		e.add(at, "not support body fallback mode:%v", c.BodyFallback)
+	}
+	if c.BodyBufferSize < 0 {
+		e.add(at, "body_buffer_size must not be negative:%v", c.BodyBufferSize)
+	}
+	if _, err := proxy.ParseOrder(c.Order); err != nil {
+		e.add(at, "%v", err)
+	}
+	if _, err := proxy.ParseStrategy(c.Strategy); err != nil {
+		e.add(at, "%v", err)
+	}
+	if _, err := proxy.ParseDiffMode(c.Diff); err != nil {
+		e.add(at, "%v", err)
+	}
+	if c.Timeout.Duration < 0 {
+		e.add(at, "timeout must not be negative:%v", c.Timeout)
+	}
+	if c.PerTargetTimeout.Duration < 0 {
+		e.add(at, "per_target_timeout must not be negative:%v", c.PerTargetTimeout)
+	}
+	if c.MaxConcurrency < 0 {
+		e.add(at, "max_concurrency must not be negative:%v", c.MaxConcurrency)
+	}
+	if c.HealthCheck != nil {
+		c.HealthCheck.validate(e, location(at, "health_check"))
+	}
+	if c.CircuitBreaker != nil {
+		c.CircuitBreaker.validate(e, location(at, "circuit_breaker"))
+	}
+	if c.Retry != nil {
+		c.Retry.validate(e, location(at, "retry"))
+	}
+	if c.RateLimit != nil {
+		c.RateLimit.validate(e, location(at, "rate_limit"))
 	}
-
-	return nil
 }
 
-func (c *Config) TargetListAsURL() ([]*url.URL, error) {
-	targetList := make([]*url.URL, 0, len(c.TargetList))
+func (c *GroupConfig) Targets() ([]*proxy.Target, error) {
+	targets := make([]*proxy.Target, 0, len(c.TargetList))
 	for _, target := range c.TargetList {
-		u, err := url.Parse(target)
+		t, err := c.newTarget(target)
 		if err != nil {
 			return nil, err
 		}
-		targetList = append(targetList, u)
+		targets = append(targets, t)
 	}
-	return targetList, nil
+	return targets, nil
 }
 
+// newTarget builds target with the retry policy, rate limit and circuit
+// breaker of the group.
+func (c *GroupConfig) newTarget(target *TargetConfig) (*proxy.Target, error) {
+	u, err := proxy.ParseTargetURL(target.URL)
+	if err != nil {
+		return nil, err
+	}
+	setHeaders, err := expandHeaders(target.SetHeaders)
+	if err != nil {
+		return nil, err
+	}
+	addHeaders, err := expandHeaders(target.AddHeaders)
+	if err != nil {
+		return nil, err
+	}
+	var rewrite *proxy.Rewrite
+	if target.Rewrite != nil {
+		if rewrite, err = target.Rewrite.Rewrite(); err != nil {
+			return nil, err
+		}
+	}
+	t := &proxy.Target{
+		Name:          target.Name,
+		URL:           u,
+		Labels:        target.Labels,
+		RemoveHeaders: target.RemoveHeaders,
+		SetHeaders:    setHeaders,
+		AddHeaders:    addHeaders,
+		Rewrite:       rewrite,
+	}
+	switch {
+	case target.Retry != nil:
+		t.Retry = target.Retry.RetryPolicy()
+	case c.Retry != nil:
+		t.Retry = c.Retry.RetryPolicy()
+	}
+	switch {
+	case target.RateLimit != nil:
+		t.RateLimit = target.RateLimit.RateLimiter()
+	case c.RateLimit != nil:
+		t.RateLimit = c.RateLimit.RateLimiter()
+	}
+	if c.CircuitBreaker != nil {
+		name := t.Name
+		if name == "" {
+			name = t.String()
+		}
+		t.Breaker = proxy.NewCircuitBreaker(name, c.CircuitBreaker.BreakerConfig())
+	}
+	return t, nil
+}
+
+// NewProxy builds the proxy for the config. Each route gets its own proxy.
+// Health checkers are started, call Close on the proxy to stop them.
+func (c *Config) NewProxy() (*proxy.Proxy, error) {
+	h, err := c.GroupConfig.NewProxy()
+	if err != nil {
+		return nil, err
+	}
+	routes, err := c.NewRoutes()
+	if err != nil {
+		h.Close()
+		return nil, err
+	}
+	h.Routes = routes
+	if c.GlobalMaxConcurrency > 0 {
+		h.Semaphore = proxy.NewSemaphore(c.GlobalMaxConcurrency)
+		for _, r := range routes {
+			r.Proxy.Semaphore = h.Semaphore
+		}
+	}
+	return h, nil
+}
+
+func (c *Config) NewRoutes() ([]*proxy.Route, error) {
+	routes := make([]*proxy.Route, 0, len(c.Routes))
+	for _, r := range c.Routes {
+		h, err := r.GroupConfig.NewProxy()
+		if err != nil {
+			for _, route := range routes {
+				route.Proxy.Close()
+			}
+			return nil, err
+		}
+		route := &proxy.Route{
+			Name:   r.Name,
+			Prefix: r.Prefix,
+			Proxy:  h,
+		}
+		if r.Pattern != "" {
+			route.Pattern = regexp.MustCompile(r.Pattern)
+		}
+		if r.RouteRateLimit != nil {
+			h.RateLimit = r.RouteRateLimit.RateLimiter()
+		}
+		routes = append(routes, route)
+	}
+	return routes, nil
+}
+
+func (c *GroupConfig) NewProxy() (*proxy.Proxy, error) {
+	targets, err := c.Targets()
+	if err != nil {
+		return nil, err
+	}
+
+	h := proxy.NewProxyWithTargets(targets)
+	h.BodyFallback = c.BodyFallback
+	if c.BodyBufferSize > 0 {
+		h.BodyBufferSize = c.BodyBufferSize
+	}
+	h.Timeout = c.Timeout.Duration
+	h.PerTargetTimeout = c.PerTargetTimeout.Duration
+	h.Timing = c.Timing
+	h.Headers = c.Headers
+	h.HeaderAllowList = c.HeaderAllowList
+	h.HeaderDenyList = c.HeaderDenyList
+	h.Order, _ = proxy.ParseOrder(c.Order)
+	h.Strategy, _ = proxy.ParseStrategy(c.Strategy)
+	h.Diff, _ = proxy.ParseDiffMode(c.Diff)
+	h.DiffIgnorePaths = c.DiffIgnorePaths
+	h.Consensus = c.Consensus
+	h.MaxConcurrency = c.MaxConcurrency
+	h.NewTarget = func(name string, u *url.URL, labels map[string]string) *proxy.Target {
+		// u is parsed and the target has no headers, so this never fails
+		t, _ := c.newTarget(&TargetConfig{Name: name, URL: u.String(), Labels: labels})
+		return t
+	}
+	if c.HealthCheck != nil {
+		h.UnhealthyAction, _ = proxy.ParseUnhealthyAction(c.HealthCheck.Unhealthy)
+		h.HealthChecker = proxy.NewHealthChecker(targets, c.HealthCheck.HealthCheck())
+		h.HealthChecker.Transport = h.Transport
+		h.HealthChecker.Start()
+	}
+	return h, nil
+}
+
+var secretRegexp = regexp.MustCompile(`\$\{(env|file):([^}]+)\}`)
+
+// expandValue replaces ${env:NAME} with the environment variable and
+// ${file:/path} with the file content without trailing newline.
+func expandValue(v string) (string, error) {
+	var expandErr error
+	expanded := secretRegexp.ReplaceAllStringFunc(v, func(m string) string {
+		sub := secretRegexp.FindStringSubmatch(m)
+		switch sub[1] {
+		case "env":
+			value, ok := os.LookupEnv(sub[2])
+			if !ok && expandErr == nil {
+				expandErr = fmt.Errorf("environment variable is not set:%v", sub[2])
+			}
+			return value
+		default:
+			b, err := ioutil.ReadFile(sub[2])
+			if err != nil && expandErr == nil {
+				expandErr = err
+			}
+			return strings.TrimRight(string(b), "\r\n")
+		}
+	})
+	if expandErr != nil {
+		return "", expandErr
+	}
+	return expanded, nil
+}
+
+func expandHeaders(headers map[string]string) (http.Header, error) {
+	if len(headers) == 0 {
+		return nil, nil
+	}
+	h := make(http.Header, len(headers))
+	for name, v := range headers {
+		expanded, err := expandValue(v)
+		if err != nil {
+			return nil, fmt.Errorf("%v:%v", name, err)
+		}
+		h.Set(name, expanded)
+	}
+	return h, nil
+}
+
+// LoadConfig loads the config at p in the format of its extension.
 func LoadConfig(p string) (*Config, error) {
-	f, err := os.Open(p)
+	return LoadConfigFormat(p, "")
+}
+
+// LoadConfigFormat loads the config at p in format, which is guessed from
+// the extension of p when empty. Every problem found by validation is
+// returned at once as *ConfigError.
+func LoadConfigFormat(p string, format string) (*Config, error) {
+	if format == "" {
+		format = formatFromPath(p)
+	}
+
+	b, err := ioutil.ReadFile(p)
 	if err != nil {
 		return nil, err
 	}
+	if b, err = toJSON(b, format); err != nil {
+		return nil, err
+	}
 
-	var c Config
-	if err := json.NewDecoder(f).Decode(&c); err != nil {
+	var raw interface{}
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	if err := d.Decode(&raw); err != nil {
 		return nil, err
 	}
 
-	if err := c.validate(); err != nil {
+	// values of wrong type are reported and removed from raw, so that the
+	// rest is still decoded and validated.
+	e := &ConfigError{}
+	fc := &fieldChecker{e: e, scalarStrings: format != FormatJSON}
+	if !fc.check("", raw, reflect.TypeOf(Config{})) {
+		return nil, e
+	}
+	if b, err = json.Marshal(raw); err != nil {
+		return nil, err
+	}
+	var c Config
+	if err := json.Unmarshal(b, &c); err != nil {
 		return nil, err
 	}
 
+	ve := &ConfigError{}
+	c.validate(ve)
+	for _, problem := range ve.Problems {
+		if !fc.underInvalid(problem) {
+			e.Problems = append(e.Problems, problem)
+		}
+	}
+	if len(e.Problems) > 0 {
+		return nil, e
+	}
+
 	return &c, nil
 }
@@ -1,8 +1,13 @@
 package main
 
 import (
+	"bytes"
 	"io/ioutil"
+	"net/url"
 	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -25,6 +30,194 @@ func TestLoadConfig(t *testing.T) {
 			Content: `{"target_list":["http://example.com"],"body_fallback": 1}`,
 			Error:   "",
 		},
+		{
+			Content: `{"target_list":["http://example.com"],"body_buffer_size": -1}`,
+			Error:   "body_buffer_size must not be negative:-1",
+		},
+		{
+			Content: `{"target_list":["http://example.com"],"timeout": "-1s"}`,
+			Error:   "timeout must not be negative:-1s",
+		},
+		{
+			Content: `{"target_list":["http://example.com"],"per_target_timeout": 5}`,
+			Error:   "per_target_timeout:duration should be string such as \"1s\":5",
+		},
+		{
+			Content: `{"target_list":["http://example.com"],"timeout": "10s","per_target_timeout": "500ms"}`,
+			Error:   "",
+		},
+		{
+			Content: `{"target_list":["http://example.com"],"order": "random"}`,
+			Error:   "not support order:random",
+		},
+		{
+			Content: `{"target_list":["http://example.com"],"order": "latency"}`,
+			Error:   "",
+		},
+		{
+			Content: `{"target_list":["http://example.com"],"strategy": "quorum"}`,
+			Error:   "strategy quorum needs positive number:quorum",
+		},
+		{
+			Content: `{"target_list":["http://example.com"],"strategy": "quorum:2"}`,
+			Error:   "",
+		},
+		{
+			Content: `{"target_list":["http://example.com"],"diff": "side"}`,
+			Error:   "not support diff mode:side",
+		},
+		{
+			Content: `{"routes":[{"name":"api","prefix":"/api/","target_list":["http://example.com"],"strategy":"first"},{"pattern":"^/health$","target_list":["http://example.com"]}]}`,
+			Error:   "",
+		},
+		{
+			Content: `{"target_list":["http://example.com"],"routes":[{"prefix":"/","target_list":["http://example.com"]}]}`,
+			Error:   "target_list and routes can not be used together. add route with prefix \"/\" instead",
+		},
+		{
+			Content: `{"timeout":"-1s","strategy":"bogus","health_check":{"unhealthy":"nope"},"routes":[{"prefix":"/","target_list":["http://example.com"]}]}`,
+			Error:   "timeout can not be used with routes, set it on each route\nstrategy can not be used with routes, set it on each route\nhealth_check can not be used with routes, set it on each route",
+		},
+		{
+			Content: `{"routes":[{"target_list":["http://example.com"]}]}`,
+			Error:   "routes[0]:prefix or pattern is required",
+		},
+		{
+			Content: `{"routes":[{"prefix":"/","pattern":"^/$","target_list":["http://example.com"]}]}`,
+			Error:   "routes[0]:prefix and pattern can not be used together",
+		},
+		{
+			Content: `{"routes":[{"pattern":"(","target_list":["http://example.com"]}]}`,
+			Error:   "routes[0]:invalid pattern:error parsing regexp: missing closing ): `(`",
+		},
+		{
+			Content: `{"routes":[{"prefix":"/a","target_list":["http://example.com"]},{"prefix":"/b","target_list":[]}]}`,
+			Error:   "routes[1]:target_list is empty",
+		},
+		{
+			Content: `{"routes":[{"name":"a","prefix":"/a","target_list":["http://example.com"]},{"name":"a","prefix":"/b","target_list":["http://example.com"]}]}`,
+			Error:   "routes[1]:duplicate name:a",
+		},
+		{
+			Content: `{"target_list":["http://example.com",{"name":"tokyo-1","url":"http://10.0.0.1","labels":{"region":"tokyo"}}]}`,
+			Error:   "",
+		},
+		{
+			Content: `{"target_list":[{"name":"a"}]}`,
+			Error:   "target_list[0]:url is empty",
+		},
+		{
+			Content: `{"target_list":[{"name":"a","url":"http://10.0.0.1"},{"name":"a","url":"http://10.0.0.2"}]}`,
+			Error:   "target_list[1]:duplicate name:a",
+		},
+		{
+			Content: `{"target_list":[1]}`,
+			Error:   "target_list[0]:target should be url string or object:1",
+		},
+		{
+			Content: `{"target_list":[{"url":"http://a.com","retry":{"base_delay":5}}]}`,
+			Error:   "target_list[0]:retry:base_delay:duration should be string such as \"1s\":5",
+		},
+		{
+			Content: `{"target_list":[{"url":"http://10.0.0.1","labels":{"version":2}}]}`,
+			Error:   "target_list[0]:labels:version:should be string but got number",
+		},
+		{
+			Content: `{"target_list":[{"url":"http://10.0.0.1","set_headers":{"Authorization":"Bearer ${env:PROXY_COLLECTOR_TEST_UNSET}"}}]}`,
+			Error:   "target_list[0]:set_headers:Authorization:environment variable is not set:PROXY_COLLECTOR_TEST_UNSET",
+		},
+		{
+			Content: `{"target_list":[{"url":"http://10.0.0.1","rewrite":{"strip_prefix":"/api","add_prefix":"/v2","add_query":{"v":"2"}}}]}`,
+			Error:   "",
+		},
+		{
+			Content: `{"target_list":[{"url":"http://10.0.0.1","rewrite":{"regexp":"(","replacement":"$1"}}]}`,
+			Error:   "target_list[0]:rewrite:invalid regexp:error parsing regexp: missing closing ): `(`",
+		},
+		{
+			Content: `{"target_list":["http://example.com"],"health_check":{"path":"/health","interval":"5s","expected_status":204,"rise":2,"fall":3,"unhealthy":"report"}}`,
+			Error:   "",
+		},
+		{
+			Content: `{"target_list":["http://example.com"],"health_check":{"unhealthy":"drop"}}`,
+			Error:   "health_check:not support unhealthy action:drop",
+		},
+		{
+			Content: `{"target_list":["http://example.com"],"health_check":{"expected_status":1000}}`,
+			Error:   "health_check:invalid expected_status:1000",
+		},
+		{
+			Content: `{"target_list":["http://example.com"],"circuit_breaker":{"consecutive_failures":5,"error_rate":0.5,"min_requests":20,"window":"10s","open_timeout":"30s"}}`,
+			Error:   "",
+		},
+		{
+			Content: `{"target_list":["http://example.com"],"circuit_breaker":{"error_rate":1.5}}`,
+			Error:   "circuit_breaker:error_rate must be between 0 and 1:1.5",
+		},
+		{
+			Content: `{"target_list":["http://example.com",{"url":"http://10.0.0.1","retry":{"max_attempts":5,"non_idempotent":true}}],"retry":{"max_attempts":3,"status_codes":[502,503],"error_kinds":["connect_reset"],"base_delay":"50ms","max_delay":"1s"}}`,
+			Error:   "",
+		},
+		{
+			Content: `{"target_list":["http://example.com"],"retry":{"error_kinds":["flaky"]}}`,
+			Error:   "retry:not support error kind:flaky",
+		},
+		{
+			Content: `{"target_list":[{"url":"http://10.0.0.1","retry":{"status_codes":[1]}}]}`,
+			Error:   "target_list[0]:retry:invalid status code:1",
+		},
+		{
+			Content: `{"global_max_concurrency":100,"routes":[{"prefix":"/","target_list":["http://example.com"],"max_concurrency":10}]}`,
+			Error:   "",
+		},
+		{
+			Content: `{"target_list":["http://example.com"],"max_concurrency":-1}`,
+			Error:   "max_concurrency must not be negative:-1",
+		},
+		{
+			Content: `{"routes":[{"prefix":"/legacy/","route_rate_limit":{"rate":10,"burst":20},"target_list":["http://example.com",{"url":"http://10.0.0.1","rate_limit":{"rate":1}}],"rate_limit":{"rate":5,"burst":5,"max_wait":"200ms"}}]}`,
+			Error:   "",
+		},
+		{
+			Content: `{"target_list":["http://example.com"],"rate_limit":{"burst":5}}`,
+			Error:   "rate_limit:rate must be positive:0",
+		},
+		{
+			Content: `{"routes":[{"prefix":"/","route_rate_limit":{"rate":1,"max_wait":"-1s"},"target_list":["http://example.com"]}]}`,
+			Error:   "routes[0]:route_rate_limit:max_wait must not be negative:-1s",
+		},
+		{
+			Content: `{"target_list":["localhost:5000"]}`,
+			Error:   "target_list[0]:url scheme must be http or https:localhost:5000",
+		},
+		{
+			Content: `{"target_list":["http://"]}`,
+			Error:   "target_list[0]:url has no host:http://",
+		},
+		{
+			Content: `{"target_list":["http://10.0.0.1","http://10.0.0.1"]}`,
+			Error:   "target_list[1]:duplicate url:http://10.0.0.1. give each a name to list it more than once",
+		},
+		{
+			Content: `{"target_list":["http://10.0.0.1",{"name":"a","url":"http://10.0.0.1"}]}`,
+			Error:   "",
+		},
+		{
+			Content: `{"routes":[{"prefix":"/a","target_list":["http://example.com"]},{"prefix":"/a","target_list":["http://example.com"]}]}`,
+			Error:   "routes[1]:duplicate prefix:/a",
+		},
+		{
+			Content: `{"target_list":["http://example.com"],"tiemout":"1s"}`,
+			Error:   "unknown field:tiemout",
+		},
+		{
+			Content: `{"routes":[{"prefix":"/","target_list":[{"url":"http://10.0.0.1","label":{"region":"tokyo"}}],"retry":{"max_attempt":3}}]}`,
+			Error:   "routes[0]:retry:unknown field:max_attempt\nroutes[0]:target_list[0]:unknown field:label",
+		},
+		{
+			Content: `{"routes":[{"target_list":["http://example.com","localhost:5000"],"timeout":"-1s"}]}`,
+			Error:   "routes[0]:prefix or pattern is required\nroutes[0]:target_list[1]:url scheme must be http or https:localhost:5000\nroutes[0]:timeout must not be negative:-1s",
+		},
 	}
 
 	for _, spec := range specs {
@@ -50,3 +243,265 @@ func TestLoadConfig(t *testing.T) {
 		}
 	}
 }
+
+func TestExpandValue(t *testing.T) {
+	os.Setenv("PROXY_COLLECTOR_TEST_TOKEN", "env-token")
+	defer os.Unsetenv("PROXY_COLLECTOR_TEST_TOKEN")
+	os.Unsetenv("PROXY_COLLECTOR_TEST_UNSET")
+
+	f, err := ioutil.TempFile("", "proxy-collector-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("file-token\n")
+	f.Close()
+
+	specs := []struct {
+		Value    string
+		Expected string
+		Error    string
+	}{
+		{Value: "plain", Expected: "plain"},
+		{Value: "Bearer ${env:PROXY_COLLECTOR_TEST_TOKEN}", Expected: "Bearer env-token"},
+		{Value: "Bearer ${file:" + f.Name() + "}", Expected: "Bearer file-token"},
+		{Value: "${env:PROXY_COLLECTOR_TEST_UNSET}", Error: "environment variable is not set:PROXY_COLLECTOR_TEST_UNSET"},
+		{Value: "$HOME ${other:x}", Expected: "$HOME ${other:x}"},
+	}
+
+	for _, spec := range specs {
+		got, err := expandValue(spec.Value)
+		if err != nil {
+			if g, e := err.Error(), spec.Error; g != e {
+				t.Errorf("%v: should %v but got %v", spec.Value, e, g)
+			}
+			continue
+		}
+		if spec.Error != "" {
+			t.Errorf("%v: should %v but got nil", spec.Value, spec.Error)
+		}
+		if g, e := got, spec.Expected; g != e {
+			t.Errorf("%v: should %v but got %v", spec.Value, e, g)
+		}
+	}
+}
+
+func TestLoadConfigFormat(t *testing.T) {
+	dir, err := ioutil.TempDir("", "proxy-collector")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	type spec struct {
+		Name    string
+		Format  string
+		Content string
+		Error   string
+	}
+
+	specs := []spec{
+		{
+			Name: "config.json",
+			Content: `{
+  "target_list": ["http://localhost:5000", {"name": "tokyo-1", "url": "http://10.0.0.1:5000", "labels": {"region": "tokyo"}}],
+  "timeout": "10s",
+  "body_fallback": 1,
+  "circuit_breaker": {"error_rate": 0.5}
+}`,
+		},
+		{
+			Name: "config.yaml",
+			Content: `# targets of the dashboard
+target_list:
+  - http://localhost:5000
+  # moved to tokyo for latency
+  - name: tokyo-1
+    url: http://10.0.0.1:5000
+    labels:
+      region: tokyo
+timeout: 10s
+body_fallback: 1
+circuit_breaker:
+  error_rate: 0.5
+`,
+		},
+		{
+			Name: "config.toml",
+			Content: `# targets of the dashboard
+target_list = [
+  "http://localhost:5000",
+  # moved to tokyo for latency
+  { name = "tokyo-1", url = "http://10.0.0.1:5000", labels = { region = "tokyo" } },
+]
+timeout = "10s"
+body_fallback = 1
+
+[circuit_breaker]
+error_rate = 0.5
+`,
+		},
+		{
+			Name:    "config.conf",
+			Format:  "yaml",
+			Content: "target_list: [http://localhost:5000, {name: tokyo-1, url: 'http://10.0.0.1:5000', labels: {region: tokyo}}]\ntimeout: 10s\nbody_fallback: 1\ncircuit_breaker: {error_rate: 0.5}\n",
+		},
+		{
+			Name:    "invalid.yaml",
+			Content: "target_list: []\n",
+			Error:   "target_list is empty",
+		},
+		{
+			Name:    "invalid.toml",
+			Content: "timeout = 10\ntarget_list = [\"http://localhost:5000\"]\n",
+			Error:   "timeout:duration should be string such as \"1s\":10",
+		},
+		{
+			Name:    "config.ini",
+			Format:  "ini",
+			Content: "",
+			Error:   "not support config format:ini",
+		},
+	}
+
+	var expected *Config
+	for _, spec := range specs {
+		p := filepath.Join(dir, spec.Name)
+		if err := ioutil.WriteFile(p, []byte(spec.Content), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		c, err := LoadConfigFormat(p, spec.Format)
+		if spec.Error != "" {
+			if err == nil || err.Error() != spec.Error {
+				t.Errorf("%v: should %v but got %v", spec.Name, spec.Error, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: should no error but got %v", spec.Name, err)
+			continue
+		}
+		if expected == nil {
+			expected = c
+			continue
+		}
+		if !reflect.DeepEqual(c, expected) {
+			t.Errorf("%v: should %+v but got %+v", spec.Name, expected, c)
+		}
+	}
+}
+
+func TestLoadConfigScalarStrings(t *testing.T) {
+	dir, err := ioutil.TempDir("", "proxy-collector")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	p := filepath.Join(dir, "config.yaml")
+	content := "target_list:\n  - url: http://10.0.0.1:5000\n    labels: {version: 2, canary: true, region: tokyo}\n    set_headers: {X-Version: 2}\n"
+	if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := LoadConfig(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := c.TargetList[0]
+	if g, e := target.Labels, map[string]string{"version": "2", "canary": "true", "region": "tokyo"}; !reflect.DeepEqual(g, e) {
+		t.Errorf("should %v but got %v", e, g)
+	}
+	if g, e := target.SetHeaders, map[string]string{"X-Version": "2"}; !reflect.DeepEqual(g, e) {
+		t.Errorf("should %v but got %v", e, g)
+	}
+}
+
+func TestGroupConfigNewTarget(t *testing.T) {
+	f, err := ioutil.TempFile("", "proxy-collector")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`{"target_list":["http://10.0.0.1"],"retry":{"max_attempts":3},"rate_limit":{"rate":1},"circuit_breaker":{}}`)
+	f.Close()
+
+	c, err := LoadConfig(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := c.NewProxy()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	u, _ := url.Parse("http://10.0.0.2")
+	target := h.NewTargetWith("b", u, map[string]string{"region": "tokyo"})
+	if target.Name != "b" || target.URL.String() != "http://10.0.0.2" || target.Labels["region"] != "tokyo" {
+		t.Errorf("should be target b but got %+v", target)
+	}
+	if target.Retry == nil || target.Retry.MaxAttempts != 3 {
+		t.Errorf("should have retry policy of group but got %+v", target.Retry)
+	}
+	if target.RateLimit == nil || target.RateLimit == h.TargetList[0].RateLimit {
+		t.Errorf("should have its own rate limit but got %+v", target.RateLimit)
+	}
+	if target.Breaker == nil {
+		t.Errorf("should have circuit breaker")
+	}
+}
+
+func TestCheckConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "proxy-collector")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	type spec struct {
+		Content  string
+		Code     int
+		Expected string
+	}
+
+	specs := []spec{
+		{
+			Content:  "target_list: [http://localhost:5000]\n",
+			Code:     0,
+			Expected: "config.yaml:ok\n",
+		},
+		{
+			Content:  "target_list: [localhost:5000, 'http://']\ntimout: 1s\n",
+			Code:     1,
+			Expected: "config.yaml:unknown field:timout\nconfig.yaml:target_list[0]:url scheme must be http or https:localhost:5000\nconfig.yaml:target_list[1]:url has no host:http://\n",
+		},
+		{
+			Content:  "timeout: 5\nbody_buffer_size: big\ntarget_list: [localhost:5000, 1, {url: 'http://10.0.0.1', retry: {status_codes: [a]}}]\n",
+			Code:     1,
+			Expected: "config.yaml:body_buffer_size:should be int64 but got string\nconfig.yaml:target_list[1]:target should be url string or object:1\nconfig.yaml:target_list[2]:retry:status_codes[0]:should be int but got string\nconfig.yaml:timeout:duration should be string such as \"1s\":5\nconfig.yaml:target_list[0]:url scheme must be http or https:localhost:5000\n",
+		},
+		{
+			Content:  "target_list: [\n",
+			Code:     1,
+			Expected: "config.yaml:yaml:yaml: line 1: did not find expected node content\n",
+		},
+	}
+
+	for _, spec := range specs {
+		p := filepath.Join(dir, "config.yaml")
+		if err := ioutil.WriteFile(p, []byte(spec.Content), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		var b bytes.Buffer
+		code := checkConfig(&b, p, "")
+		if code != spec.Code {
+			t.Errorf("should %v but got %v", spec.Code, code)
+		}
+		if g, e := strings.Replace(b.String(), dir+"/", "", -1), spec.Expected; g != e {
+			t.Errorf("should %q but got %q", e, g)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	FormatJSON = "json"
+	FormatYAML = "yaml"
+	FormatTOML = "toml"
+)
+
+// formatFromPath returns the config format of the extension of p. JSON
+// is the default.
+func formatFromPath(p string) string {
+	switch strings.ToLower(filepath.Ext(p)) {
+	case ".yaml", ".yml":
+		return FormatYAML
+	case ".toml":
+		return FormatTOML
+	default:
+		return FormatJSON
+	}
+}
+
+// toJSON converts YAML and TOML config to JSON, so that every format is
+// decoded and validated the same way.
+func toJSON(b []byte, format string) ([]byte, error) {
+	var v map[string]interface{}
+	switch format {
+	case FormatJSON:
+		return b, nil
+	case FormatYAML:
+		if err := yaml.Unmarshal(b, &v); err != nil {
+			return nil, fmt.Errorf("yaml:%v", err)
+		}
+	case FormatTOML:
+		if _, err := toml.Decode(string(b), &v); err != nil {
+			return nil, fmt.Errorf("toml:%v", err)
+		}
+	default:
+		return nil, fmt.Errorf("not support config format:%v", format)
+	}
+
+	out, err := json.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("%v:%v", format, err)
+	}
+	return out, nil
+}
@@ -2,10 +2,12 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 
 	log "github.com/Sirupsen/logrus"
@@ -13,15 +15,31 @@ import (
 )
 
 var (
-	host     = flag.String("host", "0.0.0.0", "host")
-	port     = flag.String("port", "7243", "port")
-	loglevel = flag.String("loglevel", "info", "loglevel")
-	config   = flag.String("config", "proxy-collector.json", "config json")
+	host        = flag.String("host", "0.0.0.0", "host")
+	port        = flag.String("port", "7243", "port")
+	loglevel    = flag.String("loglevel", "info", "loglevel")
+	config      = flag.String("config", "proxy-collector.json", "config file")
+	configFmt   = flag.String("config-format", "", "json, yaml or toml, guessed from extension of config when empty")
+	statusPath  = flag.String("status-path", "", "path of target status on the main port such as /_status, empty to disable")
+	metricsPath = flag.String("metrics-path", "", "path of prometheus metrics on the main port such as /_metrics, empty to disable")
+	watch       = flag.Duration("watch", 0, "poll config file at this interval such as 2s and reload on change, 0 to disable")
+	adminAddr   = flag.String("admin-addr", "", "listen address of admin api such as 127.0.0.1:7244, empty to disable")
+	adminToken  = flag.String("admin-token", os.Getenv("PROXY_COLLECTOR_ADMIN_TOKEN"), "bearer token of admin api, PROXY_COLLECTOR_ADMIN_TOKEN by default")
 )
 
 func main() {
 	flag.Parse()
 
+	// proxy-collector [flags] check-config [flags] [file]
+	if flag.Arg(0) == "check-config" {
+		flag.CommandLine.Parse(flag.Args()[1:])
+		p := *config
+		if flag.NArg() > 0 {
+			p = flag.Arg(0)
+		}
+		os.Exit(checkConfig(os.Stdout, p, *configFmt))
+	}
+
 	lvl, err := log.ParseLevel(*loglevel)
 	if err != nil {
 		log.Fatal(err)
@@ -34,17 +52,27 @@ func main() {
 }
 
 func _main() error {
-	c, err := LoadConfig(*config)
+	c, err := LoadConfigFormat(*config, *configFmt)
 	if err != nil {
 		return err
 	}
-	targetList, err := c.TargetListAsURL()
+	h, err := c.NewProxy()
 	if err != nil {
 		return err
 	}
+	metrics := proxy.NewMetrics()
+	h.SetMetrics(metrics)
 
-	h := proxy.NewProxy(targetList)
-	h.BodyFallback = c.BodyFallback
+	reload := func() error {
+		err := reloadConfig(h)
+		metrics.ObserveReload(err)
+		if err != nil {
+			log.Errorf("reload config failed, keep current config:%v", err)
+			return err
+		}
+		log.Infof("reload config done")
+		return nil
+	}
 
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGHUP)
@@ -54,28 +82,68 @@ func _main() error {
 			switch sig {
 			case syscall.SIGHUP:
 				log.Info("receive hup signal. reload config...")
-				c, err := LoadConfig(*config)
-				if err != nil {
-					log.Errorf("reload config failed:%v", err)
-					break
-				}
-
-				targetList, err := c.TargetListAsURL()
-				if err != nil {
-					log.Errorf("reload config failed:%v", err)
-					break
-				}
-
-				h.M.Lock()
-				h.TargetList = targetList
-				h.BodyFallback = h.BodyFallback
-				h.M.Unlock()
-				log.Infof("reload config done")
+				reload()
 			}
 		}
 	}()
 
+	if *watch > 0 {
+		go watchConfig(*config, *watch, nil, func() { reload() })
+	}
+
+	if *adminAddr != "" {
+		if *adminToken == "" {
+			return fmt.Errorf("admin-token is required with admin-addr")
+		}
+		go func() {
+			log.Infof("start admin:%v", *adminAddr)
+			if err := http.ListenAndServe(*adminAddr, proxy.AdminHandler(h, *adminToken, reload)); err != nil {
+				log.Fatal(err)
+			}
+		}()
+	}
+
+	reserved := map[string]http.Handler{}
+	if *statusPath != "" {
+		reserved[*statusPath] = proxy.StatusHandler(h)
+	}
+	if *metricsPath != "" {
+		reserved[*metricsPath] = proxy.MetricsHandler(metrics)
+	}
+
 	addr := net.JoinHostPort(*host, *port)
 	log.Infof("start:%v", addr)
-	return http.ListenAndServe(addr, h)
+	return http.ListenAndServe(addr, withReserved(metrics.Handler(h), reserved))
+}
+
+// reloadMutex serializes reloads from SIGHUP, the watcher and the admin
+// api, so that the file read last is the config applied last.
+var reloadMutex sync.Mutex
+
+func reloadConfig(h *proxy.Proxy) error {
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+
+	c, err := LoadConfigFormat(*config, *configFmt)
+	if err != nil {
+		return err
+	}
+	nh, err := c.NewProxy()
+	if err != nil {
+		return err
+	}
+	h.Reload(nh)
+	return nil
+}
+
+// withReserved serves the handler of the reserved paths, such as status
+// and metrics, and everything else with h.
+func withReserved(h http.Handler, reserved map[string]http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if r, ok := reserved[req.URL.Path]; ok {
+			r.ServeHTTP(rw, req)
+			return
+		}
+		h.ServeHTTP(rw, req)
+	})
 }
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io/ioutil"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// watchConfig polls the file at p every interval and calls onChange when
+// its content has changed. Polling works the same for editors replacing
+// the file and for configmaps swapping a symlink. New content must be seen
+// on two polls in a row, so that a file truncated and then written in
+// place is not reported half written.
+func watchConfig(p string, interval time.Duration, stop <-chan struct{}, onChange func()) {
+	last, _ := fileHash(p)
+	var pending []byte
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		sum, err := fileHash(p)
+		if err != nil {
+			log.Warnf("watch config err:%v", err)
+			continue
+		}
+		if bytes.Equal(sum, last) {
+			pending = nil
+			continue
+		}
+		if !bytes.Equal(sum, pending) {
+			pending = sum
+			continue
+		}
+		last, pending = sum, nil
+		log.Infof("config changed:%v", p)
+		onChange()
+	}
+}
+
+func fileHash(p string) ([]byte, error) {
+	b, err := ioutil.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(b)
+	return sum[:], nil
+}
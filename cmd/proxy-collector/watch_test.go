@@ -0,0 +1,60 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWatchConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "proxy-collector")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	p := filepath.Join(dir, "config.json")
+	if err := ioutil.WriteFile(p, []byte(`{"target_list":["http://example.com"]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	changed := make(chan struct{}, 10)
+	stop := make(chan struct{})
+	defer close(stop)
+	go watchConfig(p, 10*time.Millisecond, stop, func() { changed <- struct{}{} })
+
+	select {
+	case <-changed:
+		t.Fatal("should not be called before change")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// rewriting the same content is not a change
+	writeFileAtomic(t, p, `{"target_list":["http://example.com"]}`)
+	writeFileAtomic(t, p, `{"target_list":["http://example.org"]}`)
+
+	select {
+	case <-changed:
+	case <-time.After(time.Second):
+		t.Fatal("should be called after change")
+	}
+	select {
+	case <-changed:
+		t.Fatal("should be called once")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// writeFileAtomic replaces p by renaming a temporary file, so that p is
+// never seen half written.
+func writeFileAtomic(t *testing.T, p string, content string) {
+	tmp := p + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, p); err != nil {
+		t.Fatal(err)
+	}
+}
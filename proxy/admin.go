@@ -0,0 +1,160 @@
+package proxy
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// these kinds are returned by the admin API.
+	ErrorKindUnauthorized   ErrorKind = "unauthorized"
+	ErrorKindInvalidRequest ErrorKind = "invalid_request"
+	ErrorKindNotFound       ErrorKind = "not_found"
+	ErrorKindReloadFailed   ErrorKind = "reload_failed"
+)
+
+// JsonAdminTarget is the body of POST /targets.
+type JsonAdminTarget struct {
+	Route  string            `json:"route"`
+	Name   string            `json:"name"`
+	URL    string            `json:"url"`
+	Labels map[string]string `json:"labels"`
+}
+
+// AdminHandler serves the admin API of p. Every request needs
+// "Authorization: Bearer token".
+//
+//	GET    /targets                             status of every target
+//	POST   /targets                             add a target, body is JsonAdminTarget
+//	DELETE /targets?route=NAME&target=ID        remove a target
+//	POST   /targets/drain?route=NAME&target=ID  stop sending new requests to a target
+//	POST   /reload                              call reload
+//
+// ID is the name or url of the target. route is the name of the route,
+// or its index when unnamed, and is empty only without routes for the
+// top level target list. Added targets get the settings of their group.
+// Changes are lost on reload.
+func AdminHandler(p *Proxy, token string, reload func() error) http.Handler {
+	return &adminHandler{proxy: p, token: token, reload: reload}
+}
+
+type adminHandler struct {
+	proxy  *Proxy
+	token  string
+	reload func() error
+}
+
+func (a *adminHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if !a.authorized(req) {
+		writeJSONError(rw, http.StatusUnauthorized, &JsonError{Message: "invalid token", Kind: ErrorKindUnauthorized})
+		return
+	}
+
+	switch {
+	case req.URL.Path == "/targets" && req.Method == "GET":
+		writeAdminJSON(rw, http.StatusOK, a.proxy.Status())
+	case req.URL.Path == "/targets" && req.Method == "POST":
+		a.addTarget(rw, req)
+	case req.URL.Path == "/targets" && req.Method == "DELETE":
+		a.changeTarget(rw, req, (*Proxy).RemoveTarget, "removed")
+	case req.URL.Path == "/targets/drain" && req.Method == "POST":
+		a.changeTarget(rw, req, (*Proxy).DrainTarget, "draining")
+	case req.URL.Path == "/reload" && req.Method == "POST":
+		if err := a.reload(); err != nil {
+			writeJSONError(rw, http.StatusInternalServerError, &JsonError{Message: err.Error(), Kind: ErrorKindReloadFailed})
+			return
+		}
+		writeAdminJSON(rw, http.StatusOK, a.proxy.Status())
+	default:
+		writeJSONError(rw, http.StatusNotFound, &JsonError{
+			Message: fmt.Sprintf("no admin api for %v %v", req.Method, req.URL.Path),
+			Kind:    ErrorKindNotFound,
+		})
+	}
+}
+
+func (a *adminHandler) authorized(req *http.Request) bool {
+	auth := req.Header.Get("Authorization")
+	if a.token == "" || !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(a.token)) == 1
+}
+
+func (a *adminHandler) addTarget(rw http.ResponseWriter, req *http.Request) {
+	var v JsonAdminTarget
+	if err := json.NewDecoder(req.Body).Decode(&v); err != nil {
+		writeJSONError(rw, http.StatusBadRequest, &JsonError{Message: fmt.Sprintf("invalid body:%v", err), Kind: ErrorKindInvalidRequest})
+		return
+	}
+	u, err := ParseTargetURL(v.URL)
+	if err != nil {
+		writeJSONError(rw, http.StatusBadRequest, &JsonError{Message: err.Error(), Kind: ErrorKindInvalidRequest})
+		return
+	}
+	p, ok := a.route(rw, v.Route)
+	if !ok {
+		return
+	}
+	t := p.NewTargetWith(v.Name, u, v.Labels)
+	if err := p.AddTarget(t); err != nil {
+		writeJSONError(rw, http.StatusBadRequest, &JsonError{Message: err.Error(), Kind: ErrorKindInvalidRequest})
+		return
+	}
+	log.Infof("admin added target:%v route:%v", t, v.Route)
+	writeAdminJSON(rw, http.StatusCreated, a.proxy.Status())
+}
+
+func (a *adminHandler) changeTarget(rw http.ResponseWriter, req *http.Request, change func(*Proxy, string) (*Target, bool), done string) {
+	q := req.URL.Query()
+	p, ok := a.route(rw, q.Get("route"))
+	if !ok {
+		return
+	}
+	t, ok := change(p, q.Get("target"))
+	if !ok {
+		writeNotFound(rw, "target", q.Get("target"))
+		return
+	}
+	log.Infof("admin %v target:%v route:%v", done, t, q.Get("route"))
+	writeAdminJSON(rw, http.StatusOK, a.proxy.Status())
+}
+
+// route returns the proxy of the route name, or writes the error.
+func (a *adminHandler) route(rw http.ResponseWriter, name string) (*Proxy, bool) {
+	p, ok := a.proxy.Route(name)
+	switch {
+	case ok:
+		return p, true
+	case name == "":
+		writeJSONError(rw, http.StatusBadRequest, &JsonError{Message: "route is required when routes are configured", Kind: ErrorKindInvalidRequest})
+	default:
+		writeNotFound(rw, "route", name)
+	}
+	return nil, false
+}
+
+func writeNotFound(rw http.ResponseWriter, what, id string) {
+	writeJSONError(rw, http.StatusNotFound, &JsonError{
+		Message: fmt.Sprintf("no %v:%v", what, id),
+		Kind:    ErrorKindNotFound,
+	})
+}
+
+func writeAdminJSON(rw http.ResponseWriter, statusCode int, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		log.Errorf("json encode err:%v", err)
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(statusCode)
+	rw.Write(append(b, '\n'))
+}
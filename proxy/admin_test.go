@@ -0,0 +1,229 @@
+package proxy
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestAdminHandler(t *testing.T) {
+	u, _ := url.Parse("http://10.0.0.1")
+	api := NewProxyWithTargets([]*Target{{Name: "a", URL: u}})
+	root := NewProxy(nil)
+	root.Routes = []*Route{{Name: "api", Prefix: "/api/", Proxy: api}, {Prefix: "/", Proxy: NewProxy(nil)}}
+
+	reloaded := 0
+	reloadErr := error(nil)
+	handler := AdminHandler(root, "secret", func() error {
+		reloaded++
+		return reloadErr
+	})
+
+	type spec struct {
+		Method     string
+		Path       string
+		Body       string
+		Token      string
+		StatusCode int
+		Expected   string
+	}
+
+	specs := []spec{
+		{
+			Method:     "GET",
+			Path:       "/targets",
+			Token:      "wrong",
+			StatusCode: http.StatusUnauthorized,
+			Expected:   `{"error":{"message":"invalid token","kind":"unauthorized"}}`,
+		},
+		{
+			Method:     "GET",
+			Path:       "/targets",
+			StatusCode: http.StatusOK,
+			Expected:   `{"targets":[{"route":"api","index":0,"target":"http://10.0.0.1","name":"a"}]}`,
+		},
+		{
+			Method:     "POST",
+			Path:       "/targets",
+			Body:       `{"route":"api","name":"b","url":"http://10.0.0.2"}`,
+			StatusCode: http.StatusCreated,
+			Expected:   `{"targets":[{"route":"api","index":0,"target":"http://10.0.0.1","name":"a"},{"route":"api","index":1,"target":"http://10.0.0.2","name":"b"}]}`,
+		},
+		{
+			Method:     "POST",
+			Path:       "/targets",
+			Body:       `{"route":"api","name":"b","url":"http://10.0.0.3"}`,
+			StatusCode: http.StatusBadRequest,
+			Expected:   `{"error":{"message":"duplicate name:b","kind":"invalid_request"}}`,
+		},
+		{
+			Method:     "POST",
+			Path:       "/targets",
+			Body:       `{"route":"api","url":"http://10.0.0.9"}`,
+			StatusCode: http.StatusCreated,
+		},
+		{
+			Method:     "POST",
+			Path:       "/targets",
+			Body:       `{"route":"api","url":"http://10.0.0.9"}`,
+			StatusCode: http.StatusBadRequest,
+			Expected:   `{"error":{"message":"duplicate url:http://10.0.0.9. give each a name to list it more than once","kind":"invalid_request"}}`,
+		},
+		{
+			Method:     "DELETE",
+			Path:       "/targets?route=api&target=http://10.0.0.9",
+			StatusCode: http.StatusOK,
+		},
+		{
+			Method:     "POST",
+			Path:       "/targets",
+			Body:       `{"url":"10.0.0.3"}`,
+			StatusCode: http.StatusBadRequest,
+			Expected:   `{"error":{"message":"url scheme must be http or https:10.0.0.3","kind":"invalid_request"}}`,
+		},
+		{
+			Method:     "POST",
+			Path:       "/targets",
+			Body:       `{"route":"api","url":"ftp://10.0.0.3"}`,
+			StatusCode: http.StatusBadRequest,
+			Expected:   `{"error":{"message":"url scheme must be http or https:ftp://10.0.0.3","kind":"invalid_request"}}`,
+		},
+		{
+			Method:     "POST",
+			Path:       "/targets/drain?route=api&target=a",
+			StatusCode: http.StatusOK,
+			Expected:   `{"targets":[{"route":"api","index":0,"target":"http://10.0.0.1","name":"a","draining":true},{"route":"api","index":1,"target":"http://10.0.0.2","name":"b"}]}`,
+		},
+		{
+			Method:     "DELETE",
+			Path:       "/targets?route=api&target=http://10.0.0.2",
+			StatusCode: http.StatusOK,
+			Expected:   `{"targets":[{"route":"api","index":0,"target":"http://10.0.0.1","name":"a","draining":true}]}`,
+		},
+		{
+			Method:     "DELETE",
+			Path:       "/targets?route=web&target=a",
+			StatusCode: http.StatusNotFound,
+			Expected:   `{"error":{"message":"no route:web","kind":"not_found"}}`,
+		},
+		{
+			Method:     "DELETE",
+			Path:       "/targets?route=api&target=c",
+			StatusCode: http.StatusNotFound,
+			Expected:   `{"error":{"message":"no target:c","kind":"not_found"}}`,
+		},
+		{
+			Method:     "POST",
+			Path:       "/targets",
+			Body:       `{"url":"http://10.0.0.4"}`,
+			StatusCode: http.StatusBadRequest,
+			Expected:   `{"error":{"message":"route is required when routes are configured","kind":"invalid_request"}}`,
+		},
+		{
+			Method:     "POST",
+			Path:       "/targets",
+			Body:       `{"route":"1","url":"http://10.0.0.4"}`,
+			StatusCode: http.StatusCreated,
+			Expected:   `{"targets":[{"route":"api","index":0,"target":"http://10.0.0.1","name":"a","draining":true},{"route":"1","index":0,"target":"http://10.0.0.4"}]}`,
+		},
+		{
+			Method:     "DELETE",
+			Path:       "/targets?route=2&target=http://10.0.0.4",
+			StatusCode: http.StatusNotFound,
+			Expected:   `{"error":{"message":"no route:2","kind":"not_found"}}`,
+		},
+		{
+			Method:     "POST",
+			Path:       "/reload",
+			StatusCode: http.StatusOK,
+		},
+		{
+			Method:     "PUT",
+			Path:       "/reload",
+			StatusCode: http.StatusNotFound,
+			Expected:   `{"error":{"message":"no admin api for PUT /reload","kind":"not_found"}}`,
+		},
+	}
+
+	for _, spec := range specs {
+		req := httptest.NewRequest(spec.Method, spec.Path, strings.NewReader(spec.Body))
+		token := spec.Token
+		if token == "" {
+			token = "secret"
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		if g, e := rec.Code, spec.StatusCode; g != e {
+			t.Errorf("%v %v: should %v but got %v", spec.Method, spec.Path, e, g)
+		}
+		if spec.Expected == "" {
+			continue
+		}
+		if g, e := strings.TrimSpace(rec.Body.String()), spec.Expected; g != e {
+			t.Errorf("%v %v: should %v but got %v", spec.Method, spec.Path, e, g)
+		}
+	}
+
+	if g, e := reloaded, 1; g != e {
+		t.Errorf("should %v but got %v", e, g)
+	}
+
+	reloadErr = errors.New("invalid config")
+	req := httptest.NewRequest("POST", "/reload", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if g, e := strings.TrimSpace(rec.Body.String()), `{"error":{"message":"invalid config","kind":"reload_failed"}}`; g != e {
+		t.Errorf("should %v but got %v", e, g)
+	}
+}
+
+func TestProxyDrainTarget(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer backend.Close()
+
+	u, _ := url.Parse(backend.URL)
+	proxy := NewProxyWithTargets([]*Target{{Name: "a", URL: u}, {Name: "b", URL: u}})
+	if _, ok := proxy.DrainTarget("a"); !ok {
+		t.Fatal("target should be found")
+	}
+
+	rec := httptest.NewRecorder()
+	proxy.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if g, e := strings.TrimSpace(rec.Body.String()), `[{"index":1,"target":"`+backend.URL+`","name":"b","body":"","status_code":200}]`; g != e {
+		t.Errorf("should %v but got %v", e, g)
+	}
+}
+
+func TestProxyAddTargetDuplicate(t *testing.T) {
+	proxy := NewProxy(nil)
+	u, _ := url.Parse("http://10.0.0.1")
+
+	var wg sync.WaitGroup
+	var added int32
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := proxy.AddTarget(&Target{Name: "a", URL: u}); err == nil {
+				atomic.AddInt32(&added, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	if g, e := atomic.LoadInt32(&added), int32(1); g != e {
+		t.Errorf("should %v but got %v", e, g)
+	}
+	if g, e := len(proxy.Targets()), 1; g != e {
+		t.Errorf("should %v but got %v", e, g)
+	}
+}
@@ -0,0 +1,74 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// DefaultBodyBufferSize is the amount of request body kept in memory
+// before it is spilled to a temporary file.
+const DefaultBodyBufferSize int64 = 1 << 20
+
+// bufferedBody holds the inbound request body so that it can be
+// replayed to every target.
+type bufferedBody struct {
+	buf  []byte
+	file *os.File
+	size int64
+}
+
+// newBufferedBody reads r until EOF. Up to limit bytes are kept in
+// memory, anything larger is written to a temporary file.
+func newBufferedBody(r io.Reader, limit int64) (*bufferedBody, error) {
+	if r == nil {
+		return &bufferedBody{}, nil
+	}
+	if limit <= 0 {
+		limit = DefaultBodyBufferSize
+	}
+
+	buf, err := ioutil.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(buf)) <= limit {
+		return &bufferedBody{buf: buf, size: int64(len(buf))}, nil
+	}
+
+	f, err := ioutil.TempFile("", "proxy-collector-body")
+	if err != nil {
+		return nil, err
+	}
+	b := &bufferedBody{file: f}
+	n, err := io.Copy(f, io.MultiReader(bytes.NewReader(buf), r))
+	if err != nil {
+		b.Close()
+		return nil, err
+	}
+	b.size = n
+	return b, nil
+}
+
+// Size returns the length of the buffered body.
+func (b *bufferedBody) Size() int64 {
+	return b.size
+}
+
+// NewReader returns an independent reader positioned at the start of the body.
+func (b *bufferedBody) NewReader() io.ReadCloser {
+	if b.file != nil {
+		return ioutil.NopCloser(io.NewSectionReader(b.file, 0, b.size))
+	}
+	return ioutil.NopCloser(bytes.NewReader(b.buf))
+}
+
+// Close removes the temporary file, if any.
+func (b *bufferedBody) Close() error {
+	if b.file == nil {
+		return nil
+	}
+	b.file.Close()
+	return os.Remove(b.file.Name())
+}
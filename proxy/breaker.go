@@ -0,0 +1,214 @@
+package proxy
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+type BreakerState string
+
+const (
+	// BreakerClosed lets every request through.
+	BreakerClosed BreakerState = "closed"
+	// BreakerOpen fails every request fast until OpenTimeout has passed.
+	BreakerOpen BreakerState = "open"
+	// BreakerHalfOpen lets one trial request through. Its result closes
+	// or opens the breaker again.
+	BreakerHalfOpen BreakerState = "half_open"
+)
+
+// BreakerConfig decides when a breaker opens. It opens after
+// ConsecutiveFailures failures in a row, or when at least MinRequests
+// requests were done within Window and ErrorRate of them failed. Zero
+// disables each condition.
+type BreakerConfig struct {
+	ConsecutiveFailures int
+	ErrorRate           float64
+	MinRequests         int
+	Window              time.Duration
+	// OpenTimeout is how long the breaker stays open before half-open.
+	OpenTimeout time.Duration
+}
+
+const (
+	DefaultBreakerConsecutiveFailures = 5
+	DefaultBreakerMinRequests         = 10
+	DefaultBreakerWindow              = 10 * time.Second
+	DefaultBreakerOpenTimeout         = 30 * time.Second
+)
+
+type breakerResult struct {
+	at     time.Time
+	failed bool
+}
+
+// CircuitBreaker guards the requests to one target.
+type CircuitBreaker struct {
+	Config BreakerConfig
+	// Name is used in logs.
+	Name string
+
+	m        sync.Mutex
+	state    BreakerState
+	failures int
+	results  []breakerResult
+	openedAt time.Time
+	trial    bool
+	now      func() time.Time
+}
+
+func NewCircuitBreaker(name string, config BreakerConfig) *CircuitBreaker {
+	if config.ConsecutiveFailures <= 0 && config.ErrorRate <= 0 {
+		config.ConsecutiveFailures = DefaultBreakerConsecutiveFailures
+	}
+	if config.MinRequests <= 0 {
+		config.MinRequests = DefaultBreakerMinRequests
+	}
+	if config.Window <= 0 {
+		config.Window = DefaultBreakerWindow
+	}
+	if config.OpenTimeout <= 0 {
+		config.OpenTimeout = DefaultBreakerOpenTimeout
+	}
+	return &CircuitBreaker{
+		Config: config,
+		Name:   name,
+		state:  BreakerClosed,
+		now:    time.Now,
+	}
+}
+
+func (b *CircuitBreaker) State() BreakerState {
+	b.m.Lock()
+	defer b.m.Unlock()
+	if b.state == BreakerOpen && b.now().Sub(b.openedAt) >= b.Config.OpenTimeout {
+		return BreakerHalfOpen
+	}
+	return b.state
+}
+
+// Allow reports whether a request may be sent. Every allowed request must
+// be followed by Done or Abort.
+func (b *CircuitBreaker) Allow() bool {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	switch b.state {
+	case BreakerClosed:
+		return true
+	case BreakerOpen:
+		if b.now().Sub(b.openedAt) < b.Config.OpenTimeout {
+			return false
+		}
+		b.setState(BreakerHalfOpen)
+	}
+
+	if b.trial {
+		return false
+	}
+	b.trial = true
+	return true
+}
+
+// Done records the result of an allowed request.
+func (b *CircuitBreaker) Done(failed bool) {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	switch b.state {
+	case BreakerOpen:
+		// late result of a request allowed before the breaker opened
+		return
+	case BreakerHalfOpen:
+		b.trial = false
+		if failed {
+			b.open()
+		} else {
+			b.close()
+		}
+		return
+	}
+
+	now := b.now()
+	b.results = append(b.results, breakerResult{at: now, failed: failed})
+	b.prune(now)
+	if !failed {
+		b.failures = 0
+		return
+	}
+	b.failures++
+
+	if b.Config.ConsecutiveFailures > 0 && b.failures >= b.Config.ConsecutiveFailures {
+		b.open()
+		return
+	}
+	if b.Config.ErrorRate > 0 && len(b.results) >= b.Config.MinRequests {
+		failed := 0
+		for _, r := range b.results {
+			if r.failed {
+				failed++
+			}
+		}
+		if float64(failed)/float64(len(b.results)) >= b.Config.ErrorRate {
+			b.open()
+		}
+	}
+}
+
+// doneRoundTrip records the result of a round trip. Errors and 5xx are
+// failures, cancelled requests are not counted.
+func (b *CircuitBreaker) doneRoundTrip(res *http.Response, err error) {
+	switch {
+	case err != nil && classifyError(err) == ErrorKindCanceled:
+		b.Abort()
+	case err != nil:
+		b.Done(true)
+	default:
+		b.Done(res.StatusCode >= 500)
+	}
+}
+
+// Abort releases an allowed request without recording it, such as one
+// cancelled by the client.
+func (b *CircuitBreaker) Abort() {
+	b.m.Lock()
+	defer b.m.Unlock()
+	if b.state == BreakerHalfOpen {
+		b.trial = false
+	}
+}
+
+func (b *CircuitBreaker) prune(now time.Time) {
+	i := 0
+	for i < len(b.results) && now.Sub(b.results[i].at) > b.Config.Window {
+		i++
+	}
+	b.results = b.results[i:]
+}
+
+func (b *CircuitBreaker) open() {
+	b.openedAt = b.now()
+	b.setState(BreakerOpen)
+}
+
+func (b *CircuitBreaker) close() {
+	b.failures = 0
+	b.results = nil
+	b.setState(BreakerClosed)
+}
+
+func (b *CircuitBreaker) setState(state BreakerState) {
+	if b.state == state {
+		return
+	}
+	switch state {
+	case BreakerOpen:
+		log.Warnf("circuit breaker target:%v %v -> %v", b.Name, b.state, state)
+	default:
+		log.Infof("circuit breaker target:%v %v -> %v", b.Name, b.state, state)
+	}
+	b.state = state
+}
@@ -0,0 +1,91 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCircuitBreakerConsecutiveFailures(t *testing.T) {
+	now := time.Unix(0, 0)
+	b := NewCircuitBreaker("test", BreakerConfig{ConsecutiveFailures: 3, OpenTimeout: time.Second})
+	b.now = func() time.Time { return now }
+
+	type step struct {
+		Advance time.Duration
+		Allowed bool
+		Failed  bool
+		State   BreakerState
+	}
+
+	steps := []step{
+		{Allowed: true, Failed: true, State: BreakerClosed},
+		{Allowed: true, Failed: false, State: BreakerClosed},
+		{Allowed: true, Failed: true, State: BreakerClosed},
+		{Allowed: true, Failed: true, State: BreakerClosed},
+		{Allowed: true, Failed: true, State: BreakerOpen},
+		{Advance: 500 * time.Millisecond, Allowed: false, State: BreakerOpen},
+		{Advance: 500 * time.Millisecond, Allowed: true, Failed: true, State: BreakerOpen},
+		{Advance: time.Second, Allowed: true, Failed: false, State: BreakerClosed},
+		{Allowed: true, Failed: true, State: BreakerClosed},
+	}
+
+	for i, step := range steps {
+		now = now.Add(step.Advance)
+		if g, e := b.Allow(), step.Allowed; g != e {
+			t.Fatalf("step %d: allow should %v but got %v", i, e, g)
+		}
+		if step.Allowed {
+			b.Done(step.Failed)
+		}
+		if g, e := b.State(), step.State; g != e {
+			t.Errorf("step %d: state should %v but got %v", i, e, g)
+		}
+	}
+}
+
+func TestCircuitBreakerHalfOpenTrial(t *testing.T) {
+	now := time.Unix(0, 0)
+	b := NewCircuitBreaker("test", BreakerConfig{ConsecutiveFailures: 1, OpenTimeout: time.Second})
+	b.now = func() time.Time { return now }
+
+	b.Allow()
+	b.Done(true)
+	now = now.Add(time.Second)
+
+	if g, e := b.State(), BreakerHalfOpen; g != e {
+		t.Fatalf("should %v but got %v", e, g)
+	}
+	if !b.Allow() {
+		t.Fatal("first trial should be allowed")
+	}
+	if b.Allow() {
+		t.Fatal("second trial should not be allowed while the first is running")
+	}
+	b.Abort()
+	if !b.Allow() {
+		t.Fatal("trial should be allowed after abort")
+	}
+}
+
+func TestCircuitBreakerErrorRate(t *testing.T) {
+	now := time.Unix(0, 0)
+	b := NewCircuitBreaker("test", BreakerConfig{ErrorRate: 0.5, MinRequests: 4, Window: 10 * time.Second})
+	b.now = func() time.Time { return now }
+
+	// old results fall out of the window
+	for i := 0; i < 3; i++ {
+		b.Allow()
+		b.Done(true)
+	}
+	now = now.Add(11 * time.Second)
+
+	for i, failed := range []bool{false, true, false, true} {
+		if !b.Allow() {
+			t.Fatalf("request %d should be allowed", i)
+		}
+		b.Done(failed)
+	}
+	if g, e := b.State(), BreakerOpen; g != e {
+		t.Errorf("should %v but got %v", e, g)
+	}
+}
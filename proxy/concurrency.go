@@ -0,0 +1,34 @@
+package proxy
+
+import (
+	"context"
+)
+
+// Semaphore bounds the number of outbound requests in flight. One
+// Semaphore can be shared by several Proxy to bound the whole process.
+type Semaphore struct {
+	slots chan struct{}
+}
+
+func NewSemaphore(n int) *Semaphore {
+	return &Semaphore{slots: make(chan struct{}, n)}
+}
+
+// Acquire waits for a free slot or until ctx is done.
+func (s *Semaphore) Acquire(ctx context.Context) error {
+	select {
+	case s.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *Semaphore) Release() {
+	<-s.slots
+}
+
+// InFlight returns the number of acquired slots.
+func (s *Semaphore) InFlight() int {
+	return len(s.slots)
+}
@@ -0,0 +1,122 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestProxyMaxConcurrency(t *testing.T) {
+	type spec struct {
+		MaxConcurrency int
+		Semaphore      int
+		Expected       int32
+	}
+
+	specs := []spec{
+		{MaxConcurrency: 3, Expected: 3},
+		{Semaphore: 2, Expected: 2},
+		{MaxConcurrency: 3, Semaphore: 1, Expected: 1},
+	}
+
+	for _, spec := range specs {
+		var inFlight, max int32
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			n := atomic.AddInt32(&inFlight, 1)
+			defer atomic.AddInt32(&inFlight, -1)
+			for {
+				m := atomic.LoadInt32(&max)
+				if n <= m || atomic.CompareAndSwapInt32(&max, m, n) {
+					break
+				}
+			}
+			time.Sleep(10 * time.Millisecond)
+			w.WriteHeader(http.StatusOK)
+		}))
+
+		backendURL, _ := url.Parse(backend.URL)
+		urls := make([]*url.URL, 20)
+		for i := range urls {
+			urls[i] = backendURL
+		}
+		proxy := NewProxy(urls)
+		proxy.MaxConcurrency = spec.MaxConcurrency
+		if spec.Semaphore > 0 {
+			proxy.Semaphore = NewSemaphore(spec.Semaphore)
+		}
+
+		rec := httptest.NewRecorder()
+		proxy.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+		backend.Close()
+
+		var jsonItems []JsonItem
+		if err := json.Unmarshal(rec.Body.Bytes(), &jsonItems); err != nil {
+			t.Fatal(err)
+		}
+		if g, e := len(jsonItems), len(urls); g != e {
+			t.Errorf("should %v but got %v", e, g)
+		}
+		for _, item := range jsonItems {
+			if item.Error != nil {
+				t.Errorf("should no error but got %v", item.Error)
+			}
+		}
+		if g, e := atomic.LoadInt32(&max), spec.Expected; g > e {
+			t.Errorf("%+v: concurrency should be at most %v but got %v", spec, e, g)
+		}
+		if g := proxy.Semaphore; g != nil && g.InFlight() != 0 {
+			t.Errorf("semaphore should be released but got %v", g.InFlight())
+		}
+	}
+}
+
+// BenchmarkProxyFanOut reports latency (ns/op) and memory (B/op) of one
+// inbound request fanned out to local httptest targets.
+func BenchmarkProxyFanOut(b *testing.B) {
+	for _, n := range []int{10, 100, 5000} {
+		for _, maxConcurrency := range []int{0, 100} {
+			b.Run(fmt.Sprintf("targets=%d/max_concurrency=%d", n, maxConcurrency), func(b *testing.B) {
+				benchmarkProxyFanOut(b, n, maxConcurrency)
+			})
+		}
+	}
+}
+
+func benchmarkProxyFanOut(b *testing.B, n int, maxConcurrency int) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Length", "11")
+		w.Write([]byte(`{"ok":true}`))
+	})
+
+	urls := make([]*url.URL, n)
+	for i := range urls {
+		backend := httptest.NewServer(handler)
+		defer backend.Close()
+		urls[i], _ = url.Parse(backend.URL)
+	}
+
+	transport := &http.Transport{MaxIdleConnsPerHost: 1}
+	defer transport.CloseIdleConnections()
+
+	proxy := NewProxy(urls)
+	proxy.Transport = transport
+	proxy.MaxConcurrency = maxConcurrency
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rec := httptest.NewRecorder()
+		proxy.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+		if rec.Code != http.StatusOK {
+			b.Fatalf("should %v but got %v", http.StatusOK, rec.Code)
+		}
+		ioutil.ReadAll(rec.Body)
+	}
+}
@@ -0,0 +1,94 @@
+package proxy
+
+import (
+	"encoding/json"
+	"sort"
+)
+
+type ConsensusResult string
+
+const (
+	// ConsensusUnanimous means every target answered the same.
+	ConsensusUnanimous ConsensusResult = "unanimous"
+	// ConsensusMajority means more than half of the targets answered the same.
+	ConsensusMajority ConsensusResult = "majority"
+	// ConsensusNone means no answer got more than half of the targets.
+	ConsensusNone ConsensusResult = "none"
+)
+
+// ConsensusHeader is the response header carrying ConsensusResult.
+const ConsensusHeader = "X-Proxy-Collector-Consensus"
+
+// JsonConsensus is the most common answer among targets. Targets are
+// grouped by status code and body, ignoring JSON formatting and key
+// order. Targets with error never agree with anyone.
+type JsonConsensus struct {
+	Result     ConsensusResult `json:"result"`
+	StatusCode int             `json:"status_code"`
+	Body       json.RawMessage `json:"body"`
+	Agreed     []int           `json:"agreed"`
+	Dissenters []*JsonItem     `json:"dissenters"`
+}
+
+func consensusItems(items []*JsonItem) *JsonConsensus {
+	sorted := make([]*JsonItem, 0, len(items))
+	for _, item := range items {
+		if item != nil {
+			sorted = append(sorted, item)
+		}
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Index < sorted[j].Index })
+
+	groups := map[string][]*JsonItem{}
+	var keys []string
+	for _, item := range sorted {
+		if item.Error != nil {
+			continue
+		}
+		key := canonicalKey(item)
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], item)
+	}
+	// keys are in order of the first member, so ties go to the group whose
+	// first member comes first
+	var best []*JsonItem
+	for _, key := range keys {
+		if len(groups[key]) > len(best) {
+			best = groups[key]
+		}
+	}
+
+	c := &JsonConsensus{
+		Result:     ConsensusNone,
+		Body:       json.RawMessage("null"),
+		Agreed:     []int{},
+		Dissenters: []*JsonItem{},
+	}
+	if len(best) == 0 {
+		c.Dissenters = append(c.Dissenters, sorted...)
+		return c
+	}
+
+	agreed := map[int]bool{}
+	for _, item := range best {
+		agreed[item.Index] = true
+		c.Agreed = append(c.Agreed, item.Index)
+	}
+	for _, item := range sorted {
+		if !agreed[item.Index] {
+			c.Dissenters = append(c.Dissenters, item)
+		}
+	}
+
+	c.StatusCode = best[0].StatusCode
+	c.Body = best[0].Body
+	switch {
+	case len(best) == len(sorted):
+		c.Result = ConsensusUnanimous
+	case len(best)*2 > len(sorted):
+		c.Result = ConsensusMajority
+	}
+	return c
+}
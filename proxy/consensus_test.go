@@ -0,0 +1,95 @@
+package proxy
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestConsensusItems(t *testing.T) {
+	type spec struct {
+		Items      []*JsonItem
+		Result     ConsensusResult
+		Body       string
+		Agreed     []int
+		Dissenters []int
+	}
+
+	specs := []spec{
+		{
+			Items: []*JsonItem{
+				{Index: 0, StatusCode: 200, Body: json.RawMessage(`{"a":1,"b":2}`)},
+				{Index: 1, StatusCode: 200, Body: json.RawMessage(`{"b":2, "a":1}`)},
+			},
+			Result:     ConsensusUnanimous,
+			Body:       `{"a":1,"b":2}`,
+			Agreed:     []int{0, 1},
+			Dissenters: []int{},
+		},
+		{
+			Items: []*JsonItem{
+				{Index: 0, StatusCode: 200, Body: json.RawMessage(`{"a":1}`)},
+				{Index: 1, StatusCode: 200, Body: json.RawMessage(`{"a":2}`)},
+				{Index: 2, StatusCode: 200, Body: json.RawMessage(`{"a":2}`)},
+				{Index: 3, StatusCode: 500, Body: json.RawMessage(`{"a":2}`)},
+				{Index: 4, StatusCode: 200, Body: json.RawMessage(`{"a":2}`)},
+			},
+			Result:     ConsensusMajority,
+			Body:       `{"a":2}`,
+			Agreed:     []int{1, 2, 4},
+			Dissenters: []int{0, 3},
+		},
+		{
+			Items: []*JsonItem{
+				{Index: 0, StatusCode: 200, Body: json.RawMessage(`{"a":1}`)},
+				{Index: 1, StatusCode: 200, Body: json.RawMessage(`{"a":2}`)},
+				{Index: 2, Error: &JsonError{Kind: ErrorKindTimeout}},
+			},
+			Result:     ConsensusNone,
+			Body:       `{"a":1}`,
+			Agreed:     []int{0},
+			Dissenters: []int{1, 2},
+		},
+		{
+			Items: []*JsonItem{
+				{Index: 0, StatusCode: 200, Body: json.RawMessage(`{"a":1}`)},
+				{Index: 1, StatusCode: 200, Body: json.RawMessage(`{"a":2}`)},
+				{Index: 2, StatusCode: 200, Body: json.RawMessage(`{"a":2}`)},
+				{Index: 3, StatusCode: 200, Body: json.RawMessage(`{"a":1}`)},
+			},
+			Result:     ConsensusNone,
+			Body:       `{"a":1}`,
+			Agreed:     []int{0, 3},
+			Dissenters: []int{1, 2},
+		},
+		{
+			Items: []*JsonItem{
+				{Index: 0, Error: &JsonError{Kind: ErrorKindTimeout}},
+			},
+			Result:     ConsensusNone,
+			Body:       `null`,
+			Agreed:     []int{},
+			Dissenters: []int{0},
+		},
+	}
+
+	for i, spec := range specs {
+		c := consensusItems(spec.Items)
+		if g, e := c.Result, spec.Result; g != e {
+			t.Errorf("%d. should %v but got %v", i, e, g)
+		}
+		if g, e := string(c.Body), spec.Body; g != e {
+			t.Errorf("%d. should %v but got %v", i, e, g)
+		}
+		if g, e := c.Agreed, spec.Agreed; !reflect.DeepEqual(g, e) {
+			t.Errorf("%d. should %v but got %v", i, e, g)
+		}
+		dissenters := []int{}
+		for _, item := range c.Dissenters {
+			dissenters = append(dissenters, item.Index)
+		}
+		if g, e := dissenters, spec.Dissenters; !reflect.DeepEqual(g, e) {
+			t.Errorf("%d. should %v but got %v", i, e, g)
+		}
+	}
+}
@@ -0,0 +1,231 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// DiffMode decides whether a diff report of the target bodies is written.
+type DiffMode string
+
+const (
+	DiffNone DiffMode = "none"
+	// DiffAlongside writes the report next to the items.
+	DiffAlongside DiffMode = "alongside"
+	// DiffReplace writes the report instead of the items.
+	DiffReplace DiffMode = "replace"
+)
+
+func ParseDiffMode(s string) (DiffMode, error) {
+	switch m := DiffMode(s); m {
+	case "":
+		return DiffNone, nil
+	case DiffNone, DiffAlongside, DiffReplace:
+		return m, nil
+	default:
+		return "", fmt.Errorf("not support diff mode:%v", s)
+	}
+}
+
+// JsonDiff reports the JSON paths where target bodies differ. Only
+// targets without error are compared.
+type JsonDiff struct {
+	Identical bool            `json:"identical"`
+	Compared  []int           `json:"compared"`
+	Paths     []*JsonDiffPath `json:"paths"`
+}
+
+type JsonDiffPath struct {
+	Path   string           `json:"path"`
+	Values []*JsonDiffValue `json:"values"`
+}
+
+type JsonDiffValue struct {
+	Index   int             `json:"index"`
+	Target  string          `json:"target"`
+	Name    string          `json:"name,omitempty"`
+	Value   json.RawMessage `json:"value,omitempty"`
+	Missing bool            `json:"missing,omitempty"`
+}
+
+type diffValue struct {
+	item    *JsonItem
+	value   interface{}
+	missing bool
+}
+
+// diffItems compares the bodies of items. Paths matching one of
+// ignorePaths, and everything below them, are skipped.
+func diffItems(items []*JsonItem, ignorePaths []string) *JsonDiff {
+	d := &JsonDiff{Compared: []int{}, Paths: []*JsonDiffPath{}}
+
+	values := []*diffValue{}
+	for _, item := range items {
+		if item == nil || item.Error != nil {
+			continue
+		}
+		values = append(values, &diffValue{item: item, value: decodeBody(item.Body)})
+	}
+	sort.Slice(values, func(i, j int) bool { return values[i].item.Index < values[j].item.Index })
+	for _, v := range values {
+		d.Compared = append(d.Compared, v.item.Index)
+	}
+
+	ignore := make([]*regexp.Regexp, 0, len(ignorePaths))
+	for _, p := range ignorePaths {
+		ignore = append(ignore, compileIgnorePath(p))
+	}
+
+	d.walk("$", values, ignore)
+	d.Identical = len(d.Paths) == 0
+	return d
+}
+
+func (d *JsonDiff) walk(path string, values []*diffValue, ignore []*regexp.Regexp) {
+	for _, re := range ignore {
+		if re.MatchString(path) {
+			return
+		}
+	}
+	if len(values) < 2 {
+		return
+	}
+
+	if objects, ok := allObjects(values); ok {
+		for _, key := range unionKeys(objects) {
+			children := make([]*diffValue, len(values))
+			for i, v := range values {
+				child, ok := objects[i][key]
+				children[i] = &diffValue{item: v.item, value: child, missing: !ok}
+			}
+			d.walk(path+formatKey(key), children, ignore)
+		}
+		return
+	}
+
+	if arrays, ok := allArrays(values); ok {
+		max := 0
+		for _, a := range arrays {
+			if len(a) > max {
+				max = len(a)
+			}
+		}
+		for n := 0; n < max; n++ {
+			children := make([]*diffValue, len(values))
+			for i, v := range values {
+				children[i] = &diffValue{item: v.item, missing: n >= len(arrays[i])}
+				if !children[i].missing {
+					children[i].value = arrays[i][n]
+				}
+			}
+			d.walk(path+"["+strconv.Itoa(n)+"]", children, ignore)
+		}
+		return
+	}
+
+	if sameValues(values) {
+		return
+	}
+
+	dp := &JsonDiffPath{Path: path}
+	for _, v := range values {
+		dv := &JsonDiffValue{Index: v.item.Index, Target: v.item.Target, Name: v.item.Name, Missing: v.missing}
+		if !v.missing {
+			dv.Value, _ = json.Marshal(v.value)
+		}
+		dp.Values = append(dp.Values, dv)
+	}
+	d.Paths = append(d.Paths, dp)
+}
+
+func decodeBody(body json.RawMessage) interface{} {
+	var v interface{}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	if err := dec.Decode(&v); err != nil {
+		return string(body)
+	}
+	return v
+}
+
+func allObjects(values []*diffValue) ([]map[string]interface{}, bool) {
+	objects := make([]map[string]interface{}, len(values))
+	for i, v := range values {
+		o, ok := v.value.(map[string]interface{})
+		if v.missing || !ok {
+			return nil, false
+		}
+		objects[i] = o
+	}
+	return objects, true
+}
+
+func allArrays(values []*diffValue) ([][]interface{}, bool) {
+	arrays := make([][]interface{}, len(values))
+	for i, v := range values {
+		a, ok := v.value.([]interface{})
+		if v.missing || !ok {
+			return nil, false
+		}
+		arrays[i] = a
+	}
+	return arrays, true
+}
+
+func unionKeys(objects []map[string]interface{}) []string {
+	seen := map[string]bool{}
+	keys := []string{}
+	for _, o := range objects {
+		for k := range o {
+			if !seen[k] {
+				seen[k] = true
+				keys = append(keys, k)
+			}
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sameValues(values []*diffValue) bool {
+	var first []byte
+	for i, v := range values {
+		if v.missing {
+			return false
+		}
+		b, _ := json.Marshal(v.value)
+		if i == 0 {
+			first = b
+			continue
+		}
+		if !bytes.Equal(first, b) {
+			return false
+		}
+	}
+	return true
+}
+
+var identifierRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+func formatKey(key string) string {
+	if identifierRegexp.MatchString(key) {
+		return "." + key
+	}
+	return "[" + strconv.Quote(key) + "]"
+}
+
+// compileIgnorePath turns a path such as "$.items[*].host" into a regexp.
+// "*" matches one key or index, and the path also matches everything
+// below it.
+func compileIgnorePath(p string) *regexp.Regexp {
+	if !strings.HasPrefix(p, "$") {
+		p = "$." + strings.TrimPrefix(p, ".")
+	}
+	quoted := strings.Replace(regexp.QuoteMeta(p), `\*`, `[^.\[\]]*`, -1)
+	return regexp.MustCompile(`^` + quoted + `($|[.\[])`)
+}
@@ -0,0 +1,78 @@
+package proxy
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestDiffItems(t *testing.T) {
+	items := []*JsonItem{
+		{Index: 0, Target: "a", Body: json.RawMessage(`{"version":"1.0","host":"a","list":[1,2],"meta":{"time":1,"ok":true}}`)},
+		{Index: 1, Target: "b", Body: json.RawMessage(`{"version":"1.1","host":"b","list":[1,2,3],"meta":{"time":2,"ok":true}}`)},
+		{Index: 2, Target: "c", Error: &JsonError{Kind: ErrorKindTimeout}},
+		{Index: 3, Target: "d", Body: json.RawMessage(`{"version":"1.0","host":"d","list":[1,2],"meta":{"time":3,"ok":true},"extra":1}`)},
+	}
+
+	d := diffItems(items, []string{"$.host", "meta.time"})
+
+	if d.Identical {
+		t.Error("should not be identical")
+	}
+	if g, e := d.Compared, []int{0, 1, 3}; !reflect.DeepEqual(g, e) {
+		t.Errorf("should %v but got %v", e, g)
+	}
+
+	got := map[string][]string{}
+	for _, p := range d.Paths {
+		for _, v := range p.Values {
+			if v.Missing {
+				got[p.Path] = append(got[p.Path], v.Target+"=missing")
+			} else {
+				got[p.Path] = append(got[p.Path], v.Target+"="+string(v.Value))
+			}
+		}
+	}
+	expected := map[string][]string{
+		"$.extra":   {"a=missing", "b=missing", "d=1"},
+		"$.list[2]": {"a=missing", "b=3", "d=missing"},
+		"$.version": {`a="1.0"`, `b="1.1"`, `d="1.0"`},
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("should %v but got %v", expected, got)
+	}
+}
+
+func TestDiffItemsIdentical(t *testing.T) {
+	items := []*JsonItem{
+		{Index: 0, Target: "a", Body: json.RawMessage(`{"a":1,"b":[1,{"c":"d"}],"n":10000000000000001}`)},
+		{Index: 1, Target: "b", Body: json.RawMessage(`{"b":[1,{"c":"d"}], "a":1,"n":10000000000000001}`)},
+	}
+
+	d := diffItems(items, nil)
+	if !d.Identical || len(d.Paths) != 0 {
+		t.Errorf("should be identical but got %v", d.Paths)
+	}
+}
+
+func TestCompileIgnorePath(t *testing.T) {
+	specs := []struct {
+		Pattern string
+		Path    string
+		Match   bool
+	}{
+		{"$.host", "$.host", true},
+		{"$.host", "$.hostname", false},
+		{"$.meta", "$.meta.time", true},
+		{"$.items[*].host", "$.items[3].host", true},
+		{"$.items[*].host", "$.items[3].port", false},
+		{"$.*.time", "$.meta.time", true},
+		{"time", "$.time", true},
+	}
+
+	for _, spec := range specs {
+		if g, e := compileIgnorePath(spec.Pattern).MatchString(spec.Path), spec.Match; g != e {
+			t.Errorf("%v %v: should %v but got %v", spec.Pattern, spec.Path, e, g)
+		}
+	}
+}
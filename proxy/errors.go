@@ -0,0 +1,143 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"syscall"
+)
+
+type ErrorKind string
+
+const (
+	ErrorKindDNS            ErrorKind = "dns"
+	ErrorKindConnectRefused ErrorKind = "connect_refused"
+	ErrorKindConnectReset   ErrorKind = "connect_reset"
+	ErrorKindTimeout        ErrorKind = "timeout"
+	ErrorKindCanceled       ErrorKind = "canceled"
+	ErrorKindTLS            ErrorKind = "tls"
+	ErrorKindReadBody       ErrorKind = "read_body"
+	ErrorKindDecode         ErrorKind = "decode"
+	ErrorKindUnknown        ErrorKind = "unknown"
+	// ErrorKindUnhealthy is set on targets skipped because the health
+	// check marked them unhealthy.
+	ErrorKindUnhealthy ErrorKind = "unhealthy"
+	// ErrorKindCircuitOpen is set on targets failed fast by their open
+	// circuit breaker.
+	ErrorKindCircuitOpen ErrorKind = "circuit_open"
+	// ErrorKindRateLimited is set on targets skipped because no token of
+	// their rate limit was available in time.
+	ErrorKindRateLimited ErrorKind = "rate_limited"
+	// ErrorKindNoRoute is not about a target. It is returned when no
+	// route matches the request path.
+	ErrorKindNoRoute ErrorKind = "no_route"
+)
+
+// JsonError describes why a target has no response in the output.
+type JsonError struct {
+	Message string    `json:"message"`
+	Kind    ErrorKind `json:"kind"`
+}
+
+// TargetError is an error that already knows its kind.
+type TargetError struct {
+	Kind ErrorKind
+	Err  error
+}
+
+func (e *TargetError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *TargetError) Unwrap() error {
+	return e.Err
+}
+
+func newJsonError(err error) *JsonError {
+	return &JsonError{
+		Message: err.Error(),
+		Kind:    classifyError(err),
+	}
+}
+
+// classifyError guesses the kind of err. Timeouts win over everything
+// else so that a body read cut off by a deadline is still a timeout.
+func classifyError(err error) ErrorKind {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return ErrorKindTimeout
+	}
+	if errors.Is(err, context.Canceled) {
+		return ErrorKindCanceled
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		if dnsErr.IsTimeout {
+			return ErrorKindTimeout
+		}
+		return ErrorKindDNS
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return ErrorKindTimeout
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return ErrorKindConnectRefused
+	}
+	if isTLSError(err) {
+		return ErrorKindTLS
+	}
+	var targetErr *TargetError
+	if errors.As(err, &targetErr) {
+		return targetErr.Kind
+	}
+	if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return ErrorKindConnectReset
+	}
+	return ErrorKindUnknown
+}
+
+var errorKinds = []ErrorKind{
+	ErrorKindDNS,
+	ErrorKindConnectRefused,
+	ErrorKindConnectReset,
+	ErrorKindTimeout,
+	ErrorKindCanceled,
+	ErrorKindTLS,
+	ErrorKindReadBody,
+	ErrorKindDecode,
+	ErrorKindUnknown,
+	ErrorKindUnhealthy,
+	ErrorKindCircuitOpen,
+	ErrorKindRateLimited,
+}
+
+// ParseErrorKind accepts the kinds an item can have.
+func ParseErrorKind(s string) (ErrorKind, error) {
+	for _, k := range errorKinds {
+		if string(k) == s {
+			return k, nil
+		}
+	}
+	return "", fmt.Errorf("not support error kind:%v", s)
+}
+
+func isTLSError(err error) bool {
+	var (
+		recordErr   tls.RecordHeaderError
+		alertErr    tls.AlertError
+		verifyErr   *tls.CertificateVerificationError
+		authErr     x509.UnknownAuthorityError
+		hostnameErr x509.HostnameError
+		invalidErr  x509.CertificateInvalidError
+	)
+	return errors.As(err, &recordErr) ||
+		errors.As(err, &alertErr) ||
+		errors.As(err, &verifyErr) ||
+		errors.As(err, &authErr) ||
+		errors.As(err, &hostnameErr) ||
+		errors.As(err, &invalidErr)
+}
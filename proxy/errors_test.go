@@ -0,0 +1,36 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestClassifyError(t *testing.T) {
+	specs := []struct {
+		Err      error
+		Expected ErrorKind
+	}{
+		{&net.DNSError{Err: "no such host", Name: "example.invalid"}, ErrorKindDNS},
+		{&net.DNSError{Err: "i/o timeout", Name: "example.invalid", IsTimeout: true}, ErrorKindTimeout},
+		{&net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}, ErrorKindConnectRefused},
+		{&net.OpError{Op: "read", Err: os.NewSyscallError("read", syscall.ECONNRESET)}, ErrorKindConnectReset},
+		{&url.Error{Op: "Get", URL: "http://example.com", Err: io.EOF}, ErrorKindConnectReset},
+		{fmt.Errorf("wrapped:%w", context.DeadlineExceeded), ErrorKindTimeout},
+		{&TargetError{Kind: ErrorKindReadBody, Err: errors.New("unexpected EOF")}, ErrorKindReadBody},
+		{&TargetError{Kind: ErrorKindReadBody, Err: context.DeadlineExceeded}, ErrorKindTimeout},
+		{errors.New("something"), ErrorKindUnknown},
+	}
+
+	for _, spec := range specs {
+		if g, e := classifyError(spec.Err), spec.Expected; g != e {
+			t.Errorf("%v: should %v but got %v", spec.Err, e, g)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package proxy
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// headerFilter picks the response headers copied into JsonItem.
+type headerFilter struct {
+	allow []string
+	deny  []string
+}
+
+// headerFilterFromQuery applies the _headers query parameter on top of
+// the configured defaults. "_headers=1" and "_headers=0" switch headers
+// on and off, "_headers=ETag,X-Version" switches them on with its own
+// allow list.
+func headerFilterFromQuery(q url.Values, enabled bool, filter headerFilter) (bool, headerFilter) {
+	vs, ok := q[QueryHeaders]
+	if !ok {
+		return enabled, filter
+	}
+	if len(vs) == 0 || vs[0] == "" {
+		return true, filter
+	}
+	if b, err := strconv.ParseBool(vs[0]); err == nil {
+		return b, filter
+	}
+
+	var allow []string
+	for _, v := range vs {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				allow = append(allow, name)
+			}
+		}
+	}
+	return true, headerFilter{allow: allow, deny: filter.deny}
+}
+
+func (f headerFilter) apply(h http.Header) http.Header {
+	dst := make(http.Header)
+	if len(f.allow) > 0 {
+		for _, name := range f.allow {
+			if vv, ok := h[http.CanonicalHeaderKey(name)]; ok {
+				dst[http.CanonicalHeaderKey(name)] = append([]string(nil), vv...)
+			}
+		}
+	} else {
+		copyHeader(dst, h)
+	}
+	for _, name := range f.deny {
+		dst.Del(name)
+	}
+	return dst
+}
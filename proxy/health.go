@@ -0,0 +1,243 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// UnhealthyAction decides what ServeHTTP does with unhealthy targets.
+type UnhealthyAction string
+
+const (
+	// UnhealthyRequest sends the request anyway.
+	UnhealthyRequest UnhealthyAction = "request"
+	// UnhealthySkip leaves the target out of the output.
+	UnhealthySkip UnhealthyAction = "skip"
+	// UnhealthyReport reports the target as skipped without a round trip.
+	UnhealthyReport UnhealthyAction = "report"
+)
+
+func ParseUnhealthyAction(s string) (UnhealthyAction, error) {
+	switch a := UnhealthyAction(s); a {
+	case "":
+		return UnhealthyRequest, nil
+	case UnhealthyRequest, UnhealthySkip, UnhealthyReport:
+		return a, nil
+	default:
+		return "", fmt.Errorf("not support unhealthy action:%v", s)
+	}
+}
+
+// HealthCheck is how targets are probed.
+type HealthCheck struct {
+	// Path is joined with the target URL path.
+	Path     string
+	Interval time.Duration
+	Timeout  time.Duration
+	// ExpectedStatus is the status code of a healthy target. Zero means any 2xx.
+	ExpectedStatus int
+	// Rise is the number of consecutive successes to become healthy,
+	// Fall is the number of consecutive failures to become unhealthy.
+	Rise int
+	Fall int
+}
+
+const (
+	DefaultHealthCheckInterval = 10 * time.Second
+	DefaultHealthCheckTimeout  = 2 * time.Second
+	DefaultHealthCheckRise     = 2
+	DefaultHealthCheckFall     = 3
+)
+
+type healthState struct {
+	healthy   bool
+	successes int
+	failures  int
+	// stop stops probing the target when it is removed.
+	stop chan struct{}
+}
+
+// HealthChecker probes targets in background and keeps their state.
+// Targets start healthy.
+type HealthChecker struct {
+	Check     HealthCheck
+	Transport http.RoundTripper
+
+	m        sync.RWMutex
+	states   map[*Target]*healthState
+	started  bool
+	stopped  bool
+	stop     chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+func NewHealthChecker(targets []*Target, check HealthCheck) *HealthChecker {
+	if check.Interval <= 0 {
+		check.Interval = DefaultHealthCheckInterval
+	}
+	if check.Timeout <= 0 {
+		check.Timeout = DefaultHealthCheckTimeout
+	}
+	if check.Rise <= 0 {
+		check.Rise = DefaultHealthCheckRise
+	}
+	if check.Fall <= 0 {
+		check.Fall = DefaultHealthCheckFall
+	}
+
+	states := make(map[*Target]*healthState, len(targets))
+	for _, t := range targets {
+		states[t] = &healthState{healthy: true, stop: make(chan struct{})}
+	}
+
+	return &HealthChecker{
+		Check:     check,
+		Transport: http.DefaultTransport,
+		states:    states,
+		stop:      make(chan struct{}),
+	}
+}
+
+// Start probes every target once per interval until Stop is called.
+func (hc *HealthChecker) Start() {
+	hc.m.Lock()
+	defer hc.m.Unlock()
+	if hc.started || hc.stopped {
+		return
+	}
+	hc.started = true
+	for t, state := range hc.states {
+		hc.run(t, state)
+	}
+}
+
+// Add starts checking t, which starts healthy. Known targets are ignored.
+func (hc *HealthChecker) Add(t *Target) {
+	hc.m.Lock()
+	defer hc.m.Unlock()
+	if _, ok := hc.states[t]; ok {
+		return
+	}
+	state := &healthState{healthy: true, stop: make(chan struct{})}
+	hc.states[t] = state
+	if hc.started && !hc.stopped {
+		hc.run(t, state)
+	}
+}
+
+// Remove stops checking t.
+func (hc *HealthChecker) Remove(t *Target) {
+	hc.m.Lock()
+	defer hc.m.Unlock()
+	state, ok := hc.states[t]
+	if !ok {
+		return
+	}
+	close(state.stop)
+	delete(hc.states, t)
+}
+
+// run probes t in background. The caller must hold hc.m.
+func (hc *HealthChecker) run(t *Target, state *healthState) {
+	hc.wg.Add(1)
+	go func() {
+		defer hc.wg.Done()
+
+		ticker := time.NewTicker(hc.Check.Interval)
+		defer ticker.Stop()
+		for {
+			hc.probe(t)
+			select {
+			case <-hc.stop:
+				return
+			case <-state.stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Stop stops probing and waits for the running probes. It is safe to
+// call more than once.
+func (hc *HealthChecker) Stop() {
+	hc.m.Lock()
+	hc.stopped = true
+	hc.m.Unlock()
+
+	hc.stopOnce.Do(func() { close(hc.stop) })
+	hc.wg.Wait()
+}
+
+// Healthy reports the state of t. Unknown targets are healthy.
+func (hc *HealthChecker) Healthy(t *Target) bool {
+	hc.m.RLock()
+	defer hc.m.RUnlock()
+	state, ok := hc.states[t]
+	return !ok || state.healthy
+}
+
+func (hc *HealthChecker) probe(t *Target) {
+	err := hc.request(t)
+
+	hc.m.Lock()
+	defer hc.m.Unlock()
+
+	state, ok := hc.states[t]
+	if !ok {
+		// removed while probing
+		return
+	}
+	if err == nil {
+		state.successes++
+		state.failures = 0
+		if !state.healthy && state.successes >= hc.Check.Rise {
+			state.healthy = true
+			log.Infof("health check target:%v became healthy", t)
+		}
+		return
+	}
+
+	log.Debugf("health check target:%v err:%v", t, err)
+	state.failures++
+	state.successes = 0
+	if state.healthy && state.failures >= hc.Check.Fall {
+		state.healthy = false
+		log.Warnf("health check target:%v became unhealthy:%v", t, err)
+	}
+}
+
+func (hc *HealthChecker) request(t *Target) error {
+	ctx, cancel := context.WithTimeout(context.Background(), hc.Check.Timeout)
+	defer cancel()
+
+	u := *t.URL
+	u.Path = singleJoiningSlash(u.Path, hc.Check.Path)
+	u.RawPath = ""
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	t.applyHeaders(req)
+
+	res, err := hc.Transport.RoundTrip(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, res.Body)
+
+	if hc.Check.ExpectedStatus == 0 && is2xx(res.StatusCode) || res.StatusCode == hc.Check.ExpectedStatus {
+		return nil
+	}
+	return fmt.Errorf("unexpected status code:%v", res.StatusCode)
+}
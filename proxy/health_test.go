@@ -0,0 +1,115 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHealthCheckerRiseFall(t *testing.T) {
+	var status int32 = http.StatusOK
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/base/health" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(int(atomic.LoadInt32(&status)))
+	}))
+	defer backend.Close()
+
+	u, _ := url.Parse(backend.URL + "/base")
+	targets := NewTargets([]*url.URL{u})
+	hc := NewHealthChecker(targets, HealthCheck{Path: "/health", ExpectedStatus: http.StatusOK, Rise: 2, Fall: 3})
+
+	type step struct {
+		Status  int32
+		Healthy bool
+	}
+
+	steps := []step{
+		{http.StatusOK, true},
+		{http.StatusInternalServerError, true},
+		{http.StatusInternalServerError, true},
+		{http.StatusInternalServerError, false},
+		{http.StatusOK, false},
+		{http.StatusInternalServerError, false},
+		{http.StatusOK, false},
+		{http.StatusOK, true},
+		{http.StatusNoContent, true},
+	}
+
+	for i, step := range steps {
+		atomic.StoreInt32(&status, step.Status)
+		hc.probe(targets[0])
+		if g, e := hc.Healthy(targets[0]), step.Healthy; g != e {
+			t.Errorf("step %d: should %v but got %v", i, e, g)
+		}
+	}
+}
+
+func TestHealthCheckerAddRemove(t *testing.T) {
+	var probes int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&probes, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer backend.Close()
+
+	u, _ := url.Parse(backend.URL)
+	target := &Target{URL: u}
+	hc := NewHealthChecker(nil, HealthCheck{Interval: 10 * time.Millisecond, Fall: 1})
+	hc.Start()
+	defer hc.Stop()
+
+	hc.Add(target)
+	deadline := time.Now().Add(time.Second)
+	for hc.Healthy(target) && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if hc.Healthy(target) {
+		t.Fatal("added target should be probed")
+	}
+
+	hc.Remove(target)
+	// a probe running at Remove may still reach the backend
+	time.Sleep(30 * time.Millisecond)
+	n := atomic.LoadInt32(&probes)
+	time.Sleep(50 * time.Millisecond)
+	if g := atomic.LoadInt32(&probes); g != n {
+		t.Errorf("removed target should not be probed but got %v probes", g-n)
+	}
+	if !hc.Healthy(target) {
+		t.Errorf("removed target should be unknown and so healthy")
+	}
+}
+
+func TestParseUnhealthyAction(t *testing.T) {
+	type spec struct {
+		Input    string
+		Expected UnhealthyAction
+		Error    string
+	}
+
+	specs := []spec{
+		{Input: "", Expected: UnhealthyRequest},
+		{Input: "skip", Expected: UnhealthySkip},
+		{Input: "report", Expected: UnhealthyReport},
+		{Input: "drop", Error: "not support unhealthy action:drop"},
+	}
+
+	for _, spec := range specs {
+		a, err := ParseUnhealthyAction(spec.Input)
+		if err != nil {
+			if g, e := err.Error(), spec.Error; g != e {
+				t.Errorf("should %v but got %v", e, g)
+			}
+			continue
+		}
+		if g, e := a, spec.Expected; g != e {
+			t.Errorf("should %v but got %v", e, g)
+		}
+	}
+}
@@ -0,0 +1,304 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultBuckets are the upper bounds in seconds of latency histograms.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type metricType string
+
+const (
+	counterType   metricType = "counter"
+	gaugeType     metricType = "gauge"
+	histogramType metricType = "histogram"
+)
+
+// metricVec is a metric with one series per combination of label values.
+type metricVec struct {
+	name       string
+	help       string
+	typ        metricType
+	labelNames []string
+	buckets    []float64
+
+	m      sync.Mutex
+	series map[string]*series
+}
+
+type series struct {
+	labelValues []string
+	value       float64
+	counts      []uint64
+	count       uint64
+}
+
+func newMetricVec(name, help string, typ metricType, labelNames ...string) *metricVec {
+	v := &metricVec{
+		name:       name,
+		help:       help,
+		typ:        typ,
+		labelNames: labelNames,
+		series:     map[string]*series{},
+	}
+	if typ == histogramType {
+		v.buckets = DefaultBuckets
+	}
+	return v
+}
+
+// get returns the series of labelValues. The caller must hold v.m.
+func (v *metricVec) get(labelValues []string) *series {
+	key := strings.Join(labelValues, "\xff")
+	s, ok := v.series[key]
+	if !ok {
+		s = &series{labelValues: labelValues}
+		if v.typ == histogramType {
+			s.counts = make([]uint64, len(v.buckets))
+		}
+		v.series[key] = s
+	}
+	return s
+}
+
+func (v *metricVec) add(delta float64, labelValues ...string) {
+	v.m.Lock()
+	defer v.m.Unlock()
+	v.get(labelValues).value += delta
+}
+
+func (v *metricVec) observe(value float64, labelValues ...string) {
+	v.m.Lock()
+	defer v.m.Unlock()
+	s := v.get(labelValues)
+	for i, upper := range v.buckets {
+		if value <= upper {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.value += value
+}
+
+func (v *metricVec) write(w io.Writer) {
+	v.m.Lock()
+	defer v.m.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", v.name, v.help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", v.name, v.typ)
+
+	keys := make([]string, 0, len(v.series))
+	for k := range v.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		s := v.series[k]
+		if v.typ != histogramType {
+			fmt.Fprintf(w, "%s%s %s\n", v.name, v.labels(s, "", ""), formatFloat(s.value))
+			continue
+		}
+		for i, upper := range v.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", v.name, v.labels(s, "le", formatFloat(upper)), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", v.name, v.labels(s, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", v.name, v.labels(s, "", ""), formatFloat(s.value))
+		fmt.Fprintf(w, "%s_count%s %d\n", v.name, v.labels(s, "", ""), s.count)
+	}
+}
+
+// labels formats the labels of s, with extra label name and value when
+// name is not empty.
+func (v *metricVec) labels(s *series, name, value string) string {
+	pairs := make([]string, 0, len(v.labelNames)+1)
+	for i, n := range v.labelNames {
+		pairs = append(pairs, n+"="+escapeLabelValue(s.labelValues[i]))
+	}
+	if name != "" {
+		pairs = append(pairs, name+"="+escapeLabelValue(value))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func escapeLabelValue(v string) string {
+	v = strings.Replace(v, `\`, `\\`, -1)
+	v = strings.Replace(v, "\n", `\n`, -1)
+	v = strings.Replace(v, `"`, `\"`, -1)
+	return `"` + v + `"`
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// Metrics collects the metrics of the process. One Metrics is shared by
+// the Proxy of every route.
+type Metrics struct {
+	requests        *metricVec
+	requestDuration *metricVec
+	targetRequests  *metricVec
+	targetErrors    *metricVec
+	targetSkipped   *metricVec
+	targetDuration  *metricVec
+	fanOutsInFlight *metricVec
+	reloads         *metricVec
+}
+
+func NewMetrics() *Metrics {
+	m := &Metrics{
+		requests: newMetricVec("proxy_collector_requests_total",
+			"Inbound requests by status code.", counterType, "code"),
+		requestDuration: newMetricVec("proxy_collector_request_duration_seconds",
+			"Latency of inbound requests.", histogramType),
+		targetRequests: newMetricVec("proxy_collector_target_requests_total",
+			"Outbound requests by target and status code class, one per attempt. Failed requests have class \"error\".", counterType, "target", "class"),
+		targetErrors: newMetricVec("proxy_collector_target_errors_total",
+			"Failed targets by target and error kind, after retries. Skipped targets are not counted.", counterType, "target", "kind"),
+		targetSkipped: newMetricVec("proxy_collector_target_skipped_total",
+			"Targets not requested by target and reason.", counterType, "target", "reason"),
+		targetDuration: newMetricVec("proxy_collector_target_request_duration_seconds",
+			"Latency of outbound requests until response headers by target, one per attempt.", histogramType, "target"),
+		fanOutsInFlight: newMetricVec("proxy_collector_fanouts_in_flight",
+			"Fan-outs in progress.", gaugeType),
+		reloads: newMetricVec("proxy_collector_config_reloads_total",
+			"Config reloads by result.", counterType, "result"),
+	}
+	m.fanOutsInFlight.add(0)
+	m.reloads.add(0, "success")
+	m.reloads.add(0, "failure")
+	return m
+}
+
+// observeItem counts the final outcome of a target, failed or skipped.
+func (m *Metrics) observeItem(item *JsonItem) {
+	target := item.Name
+	if target == "" {
+		target = item.Target
+	}
+
+	switch {
+	case item.Skipped != "":
+		m.targetSkipped.add(1, target, string(item.Skipped))
+	case item.Error != nil:
+		m.targetErrors.add(1, target, string(item.Error.Kind))
+	}
+}
+
+// observeRoundTrip counts one request sent to t.
+func (m *Metrics) observeRoundTrip(t *Target, res *http.Response, err error, d time.Duration) {
+	target := t.Name
+	if target == "" {
+		target = t.String()
+	}
+
+	if err != nil {
+		m.targetRequests.add(1, target, "error")
+	} else {
+		m.targetRequests.add(1, target, strconv.Itoa(res.StatusCode/100)+"xx")
+	}
+	m.targetDuration.observe(d.Seconds(), target)
+}
+
+func (m *Metrics) fanOutStarted() {
+	m.fanOutsInFlight.add(1)
+}
+
+func (m *Metrics) fanOutDone() {
+	m.fanOutsInFlight.add(-1)
+}
+
+// ObserveReload counts a config reload, failed when err is not nil.
+func (m *Metrics) ObserveReload(err error) {
+	if err != nil {
+		m.reloads.add(1, "failure")
+		return
+	}
+	m.reloads.add(1, "success")
+}
+
+// Handler counts the inbound requests served by next.
+func (m *Metrics) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: rw, statusCode: http.StatusOK}
+		next.ServeHTTP(sw, req)
+		m.requests.add(1, strconv.Itoa(sw.statusCode))
+		m.requestDuration.observe(time.Since(start).Seconds())
+	})
+}
+
+// WriteTo writes every metric in Prometheus text format.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	cw := &countWriter{w: bufio.NewWriter(w)}
+	for _, v := range []*metricVec{
+		m.requests,
+		m.requestDuration,
+		m.targetRequests,
+		m.targetErrors,
+		m.targetSkipped,
+		m.targetDuration,
+		m.fanOutsInFlight,
+		m.reloads,
+	} {
+		v.write(cw)
+	}
+	if cw.err != nil {
+		return cw.n, cw.err
+	}
+	return cw.n, cw.w.Flush()
+}
+
+// MetricsHandler writes m in Prometheus text format.
+func MetricsHandler(m *Metrics) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		rw.WriteHeader(http.StatusOK)
+		m.WriteTo(rw)
+	})
+}
+
+type countWriter struct {
+	w   *bufio.Writer
+	n   int64
+	err error
+}
+
+func (cw *countWriter) Write(p []byte) (int, error) {
+	if cw.err != nil {
+		return 0, cw.err
+	}
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	cw.err = err
+	return n, err
+}
+
+// statusWriter records the status code and keeps streaming working.
+type statusWriter struct {
+	http.ResponseWriter
+	statusCode int
+}
+
+func (w *statusWriter) WriteHeader(statusCode int) {
+	w.statusCode = statusCode
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricVecWrite(t *testing.T) {
+	v := newMetricVec("test_seconds", "Test.", histogramType, "target")
+	v.buckets = []float64{.1, 1}
+	v.observe(.05, `a"b`)
+	v.observe(.5, `a"b`)
+	v.observe(5, `a"b`)
+
+	var b bytes.Buffer
+	v.write(&b)
+
+	expected := `# HELP test_seconds Test.
+# TYPE test_seconds histogram
+test_seconds_bucket{target="a\"b",le="0.1"} 1
+test_seconds_bucket{target="a\"b",le="1"} 2
+test_seconds_bucket{target="a\"b",le="+Inf"} 3
+test_seconds_sum{target="a\"b"} 5.55
+test_seconds_count{target="a\"b"} 3
+`
+	if g, e := b.String(), expected; g != e {
+		t.Errorf("should %v but got %v", e, g)
+	}
+}
+
+func TestProxyMetrics(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer backend.Close()
+
+	backendURL, _ := url.Parse(backend.URL)
+	downURL, _ := url.Parse("http://127.0.0.1:1")
+
+	metrics := NewMetrics()
+	proxy := NewProxyWithTargets([]*Target{
+		{Name: "up", URL: backendURL},
+		{Name: "down", URL: downURL, Retry: &RetryPolicy{MaxAttempts: 2, BaseDelay: time.Millisecond}},
+		{Name: "limited", URL: backendURL, RateLimit: NewRateLimiter(0.001, 1, 0)},
+	})
+	proxy.SetMetrics(metrics)
+	handler := metrics.Handler(proxy)
+
+	for i := 0; i < 2; i++ {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	}
+	metrics.ObserveReload(errors.New("invalid config"))
+
+	rec := httptest.NewRecorder()
+	MetricsHandler(metrics).ServeHTTP(rec, httptest.NewRequest("GET", "/_metrics", nil))
+	output := rec.Body.String()
+
+	for _, e := range []string{
+		`proxy_collector_requests_total{code="200"} 2`,
+		`proxy_collector_request_duration_seconds_count 2`,
+		`proxy_collector_target_requests_total{target="up",class="5xx"} 2`,
+		`proxy_collector_target_requests_total{target="down",class="error"} 4`,
+		`proxy_collector_target_requests_total{target="limited",class="5xx"} 1`,
+		`proxy_collector_target_errors_total{target="down",kind="connect_refused"} 2`,
+		`proxy_collector_target_skipped_total{target="limited",reason="rate_limited"} 1`,
+		`proxy_collector_target_request_duration_seconds_count{target="up"} 2`,
+		`proxy_collector_fanouts_in_flight 0`,
+		`proxy_collector_config_reloads_total{result="failure"} 1`,
+		`proxy_collector_config_reloads_total{result="success"} 0`,
+	} {
+		if !strings.Contains(output, e+"\n") {
+			t.Errorf("should contain %v but got %v", e, output)
+		}
+	}
+	for _, e := range []string{
+		`proxy_collector_target_requests_total{target="limited",class="error"}`,
+		`proxy_collector_target_errors_total{target="limited",kind="rate_limited"}`,
+	} {
+		if strings.Contains(output, e) {
+			t.Errorf("should not contain %v but got %v", e, output)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package proxy
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Query parameters read by proxy-collector itself. They are removed
+// from the query string sent to targets.
+const (
+	QueryTiming    = "_timing"
+	QueryHeaders   = "_headers"
+	QueryOrder     = "_order"
+	QueryFormat    = "_format"
+	QueryStrategy  = "_strategy"
+	QueryDiff      = "_diff"
+	QueryConsensus = "_consensus"
+)
+
+var reservedQueryKeys = []string{
+	QueryTiming,
+	QueryHeaders,
+	QueryOrder,
+	QueryFormat,
+	QueryStrategy,
+	QueryDiff,
+	QueryConsensus,
+}
+
+// requestOptions decides the optional fields of JsonItem and how the
+// output is written.
+type requestOptions struct {
+	bodyFallback BodyFallback
+	timing       bool
+	// headers is nil when headers are not wanted
+	headers  *headerFilter
+	order    Order
+	format   Format
+	strategy Strategy
+	diff     DiffMode
+	// diffIgnorePaths must not be modified, it is shared with Proxy
+	diffIgnorePaths []string
+	consensus       bool
+	// semaphore is shared with Proxy and other requests, nil means no limit
+	semaphore *Semaphore
+	// metrics is shared with Proxy, nil means no metrics
+	metrics *Metrics
+}
+
+// requestOptions merges the configured defaults with the query parameters
+// and headers of the request. The caller must hold p.m.
+func (p *Proxy) requestOptions(req *http.Request) requestOptions {
+	q := req.URL.Query()
+	opts := requestOptions{
+		bodyFallback:    p.BodyFallback,
+		timing:          p.Timing,
+		order:           p.Order,
+		format:          requestFormat(req),
+		strategy:        p.Strategy,
+		diff:            p.Diff,
+		diffIgnorePaths: p.DiffIgnorePaths,
+		consensus:       p.Consensus,
+		semaphore:       p.Semaphore,
+		metrics:         p.Metrics,
+	}
+	if v, ok := queryBool(q, QueryTiming); ok {
+		opts.timing = v
+	}
+	if order, err := ParseOrder(q.Get(QueryOrder)); err == nil && q.Get(QueryOrder) != "" {
+		opts.order = order
+	}
+	if strategy, err := ParseStrategy(q.Get(QueryStrategy)); err == nil && q.Get(QueryStrategy) != "" {
+		opts.strategy = strategy
+	}
+	if v, ok := queryBool(q, QueryDiff); ok {
+		if !v {
+			opts.diff = DiffNone
+		} else if opts.diff == DiffNone || opts.diff == "" {
+			opts.diff = DiffAlongside
+		}
+	} else if diff, err := ParseDiffMode(q.Get(QueryDiff)); err == nil && q.Get(QueryDiff) != "" {
+		opts.diff = diff
+	}
+
+	if v, ok := queryBool(q, QueryConsensus); ok {
+		opts.consensus = v
+	}
+
+	filter := headerFilter{allow: p.HeaderAllowList, deny: p.HeaderDenyList}
+	if enabled, filter := headerFilterFromQuery(q, p.Headers, filter); enabled {
+		opts.headers = &filter
+	}
+
+	return opts
+}
+
+func isReservedQueryKey(key string) bool {
+	for _, k := range reservedQueryKeys {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+// queryBool reports the boolean value of key and whether it was given.
+// A bare "?key" counts as true.
+func queryBool(q url.Values, key string) (value bool, ok bool) {
+	vs, ok := q[key]
+	if !ok {
+		return false, false
+	}
+	if len(vs) == 0 || vs[0] == "" {
+		return true, true
+	}
+	b, err := strconv.ParseBool(vs[0])
+	if err != nil {
+		return false, false
+	}
+	return b, true
+}
+
+// stripReservedQuery returns req with reserved query parameters removed.
+// Order of the remaining parameters is kept as is.
+func stripReservedQuery(req *http.Request) *http.Request {
+	if req.URL.RawQuery == "" {
+		return req
+	}
+
+	parts := strings.Split(req.URL.RawQuery, "&")
+	kept := parts[:0:0]
+	for _, part := range parts {
+		key := part
+		if i := strings.Index(key, "="); i >= 0 {
+			key = key[:i]
+		}
+		if k, err := url.QueryUnescape(key); err == nil && isReservedQueryKey(k) {
+			continue
+		}
+		kept = append(kept, part)
+	}
+	if len(kept) == len(parts) {
+		return req
+	}
+
+	outreq := new(http.Request)
+	*outreq = *req
+	u := *req.URL
+	u.RawQuery = strings.Join(kept, "&")
+	outreq.URL = &u
+	return outreq
+}
@@ -0,0 +1,53 @@
+package proxy
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Order decides the order of items in the output.
+type Order string
+
+const (
+	// OrderConfig keeps the order of TargetList.
+	OrderConfig  Order = "config"
+	OrderTarget  Order = "target"
+	OrderStatus  Order = "status"
+	OrderLatency Order = "latency"
+)
+
+func ParseOrder(s string) (Order, error) {
+	switch o := Order(s); o {
+	case "":
+		return OrderConfig, nil
+	case OrderConfig, OrderTarget, OrderStatus, OrderLatency:
+		return o, nil
+	default:
+		return "", fmt.Errorf("not support order:%v", s)
+	}
+}
+
+// sortItems sorts items by order. Ties keep the order of TargetList.
+func sortItems(items []*JsonItem, order Order) {
+	var less func(a, b *JsonItem) bool
+	switch order {
+	case OrderTarget:
+		less = func(a, b *JsonItem) bool { return a.Target < b.Target }
+	case OrderStatus:
+		less = func(a, b *JsonItem) bool { return a.StatusCode < b.StatusCode }
+	case OrderLatency:
+		less = func(a, b *JsonItem) bool { return a.duration < b.duration }
+	default:
+		less = func(a, b *JsonItem) bool { return false }
+	}
+
+	sort.SliceStable(items, func(i, j int) bool {
+		if less(items[i], items[j]) {
+			return true
+		}
+		if less(items[j], items[i]) {
+			return false
+		}
+		return items[i].Index < items[j].Index
+	})
+}
@@ -0,0 +1,190 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Format is the format of the response written to the client.
+type Format string
+
+const (
+	// FormatJSON writes one JSON array after every target is done.
+	FormatJSON Format = "json"
+	// FormatNDJSON writes one JSON line per target as soon as it is done,
+	// followed by a summary line.
+	FormatNDJSON Format = "ndjson"
+	// FormatSSE writes one "result" event per target as soon as it is
+	// done, followed by a "done" event with the summary.
+	FormatSSE Format = "sse"
+)
+
+const (
+	ndjsonContentType = "application/x-ndjson"
+	sseContentType    = "text/event-stream"
+)
+
+// requestFormat picks the format from the _format query parameter,
+// then from the Accept header.
+func requestFormat(req *http.Request) Format {
+	switch Format(req.URL.Query().Get(QueryFormat)) {
+	case FormatJSON:
+		return FormatJSON
+	case FormatNDJSON:
+		return FormatNDJSON
+	case FormatSSE:
+		return FormatSSE
+	}
+
+	for _, accept := range strings.Split(req.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accept))
+		if err != nil {
+			continue
+		}
+		switch mediaType {
+		case ndjsonContentType:
+			return FormatNDJSON
+		case sseContentType:
+			return FormatSSE
+		}
+	}
+
+	return FormatJSON
+}
+
+// JsonSummary is the last line of the NDJSON output.
+type JsonSummary struct {
+	Total     int      `json:"total"`
+	Succeeded int      `json:"succeeded"`
+	Failed    int      `json:"failed"`
+	TimedOut  []string `json:"timed_out"`
+}
+
+func (s *JsonSummary) add(item *JsonItem) {
+	s.Total++
+	if item.Error == nil {
+		s.Succeeded++
+		return
+	}
+	s.Failed++
+	if item.Error.Kind == ErrorKindTimeout {
+		s.TimedOut = append(s.TimedOut, item.Target)
+	}
+}
+
+// jsonOutput is written instead of the plain item array when diff or
+// consensus is asked for.
+type jsonOutput struct {
+	Items     *[]*JsonItem   `json:"items,omitempty"`
+	Diff      *JsonDiff      `json:"diff,omitempty"`
+	Consensus *JsonConsensus `json:"consensus,omitempty"`
+}
+
+func writeJSON(rw http.ResponseWriter, itemChan <-chan *JsonItem, n int, opts requestOptions) {
+	items := make([]*JsonItem, 0, n)
+	for item := range itemChan {
+		items = append(items, item)
+	}
+	sortItems(items, opts.order)
+
+	var v interface{} = items
+	if opts.diff != DiffNone && opts.diff != "" || opts.consensus {
+		output := &jsonOutput{}
+		if opts.diff == DiffAlongside {
+			output.Items = &items
+		}
+		if opts.diff == DiffAlongside || opts.diff == DiffReplace {
+			output.Diff = diffItems(items, opts.diffIgnorePaths)
+		}
+		if opts.consensus {
+			output.Consensus = consensusItems(items)
+			rw.Header().Set(ConsensusHeader, string(output.Consensus.Result))
+		}
+		v = output
+	}
+
+	var b bytes.Buffer
+	if err := json.NewEncoder(&b).Encode(v); err != nil {
+		log.Errorf("json encode err:%v", err)
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	rw.Write(b.Bytes())
+}
+
+func writeNDJSON(rw http.ResponseWriter, itemChan <-chan *JsonItem) {
+	writeStream(rw, itemChan, ndjsonContentType,
+		func(w io.Writer, item *JsonItem) error {
+			return json.NewEncoder(w).Encode(item)
+		},
+		func(w io.Writer, summary *JsonSummary) error {
+			return json.NewEncoder(w).Encode(struct {
+				Summary *JsonSummary `json:"summary"`
+			}{summary})
+		},
+	)
+}
+
+func writeSSE(rw http.ResponseWriter, itemChan <-chan *JsonItem) {
+	rw.Header().Set("Cache-Control", "no-cache")
+	writeStream(rw, itemChan, sseContentType,
+		func(w io.Writer, item *JsonItem) error {
+			return writeEvent(w, "result", item)
+		},
+		func(w io.Writer, summary *JsonSummary) error {
+			return writeEvent(w, "done", summary)
+		},
+	)
+}
+
+func writeEvent(w io.Writer, event string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, b)
+	return err
+}
+
+// writeStream writes and flushes each item as soon as it arrives, then
+// the summary. It stops writing once the client has gone away; the
+// pending target requests are cancelled through the request context.
+func writeStream(rw http.ResponseWriter, itemChan <-chan *JsonItem, contentType string,
+	writeItem func(io.Writer, *JsonItem) error, writeSummary func(io.Writer, *JsonSummary) error) {
+
+	rw.Header().Set("Content-Type", contentType)
+	rw.WriteHeader(http.StatusOK)
+
+	flusher, _ := rw.(http.Flusher)
+	flush := func() {
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	flush()
+
+	summary := &JsonSummary{TimedOut: []string{}}
+	for item := range itemChan {
+		summary.add(item)
+		if err := writeItem(rw, item); err != nil {
+			log.Errorf("write item err:%v", err)
+			return
+		}
+		flush()
+	}
+
+	if err := writeSummary(rw, summary); err != nil {
+		log.Errorf("write summary err:%v", err)
+	}
+	flush()
+}
@@ -10,14 +10,18 @@ package proxy
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 )
@@ -30,94 +34,536 @@ const (
 )
 
 type Proxy struct {
-	TargetList   []*url.URL
+	TargetList   []*Target
 	Transport    http.RoundTripper
 	BodyFallback BodyFallback
-	M            sync.RWMutex
+	// BodyBufferSize is the maximum request body size kept in memory.
+	// Larger bodies are spilled to a temporary file.
+	BodyBufferSize int64
+	// Timeout bounds the whole fan-out, zero means no limit.
+	Timeout time.Duration
+	// PerTargetTimeout bounds each target request, zero means no limit.
+	PerTargetTimeout time.Duration
+	// Timing adds per-target timing to every item. It can be switched
+	// per request with the _timing query parameter.
+	Timing bool
+	// Headers adds target response headers to every item. HeaderAllowList
+	// and HeaderDenyList narrow them down. It can be switched per request
+	// with the _headers query parameter.
+	Headers         bool
+	HeaderAllowList []string
+	HeaderDenyList  []string
+	// Order of items in the output. It can be changed per request with
+	// the _order query parameter.
+	Order Order
+	// Strategy decides when to stop waiting for targets. It can be
+	// changed per request with the _strategy query parameter.
+	Strategy Strategy
+	// Diff adds a report of the JSON paths where target bodies differ.
+	// Paths in DiffIgnorePaths are not compared. It can be changed per
+	// request with the _diff query parameter.
+	Diff            DiffMode
+	DiffIgnorePaths []string
+	// Consensus replaces the items with the most common answer and the
+	// targets disagreeing with it. It can be switched per request with
+	// the _consensus query parameter.
+	Consensus bool
+	// MaxConcurrency bounds the outbound requests in flight for one
+	// inbound request, zero means no limit. Semaphore, when set, bounds
+	// them across every request sharing it.
+	MaxConcurrency int
+	Semaphore      *Semaphore
+	// RateLimit, when set, bounds the inbound requests fanned out. Every
+	// target of a request over the limit is reported as rate_limited.
+	RateLimit *RateLimiter
+	// Metrics, when set, records outbound requests and fan-outs. Use
+	// SetMetrics to share it with routes.
+	Metrics *Metrics
+	// HealthChecker, when set, keeps the health of TargetList.
+	// UnhealthyAction decides what to do with unhealthy targets.
+	HealthChecker   *HealthChecker
+	UnhealthyAction UnhealthyAction
+	// NewTarget, when set, builds the targets added at runtime with the
+	// settings of the group, such as its retry policy and circuit breaker.
+	NewTarget func(name string, u *url.URL, labels map[string]string) *Target
+	// Routes, when not empty, dispatch each request to the Proxy of the
+	// first matching route instead of TargetList. Requests matching no
+	// route get 404.
+	Routes []*Route
+
+	// m guards the fields above once p serves requests. Change them with
+	// Reload and the target setters.
+	m sync.RWMutex
 }
 
+// NewProxy returns a Proxy to unnamed targets. Use NewProxyWithTargets
+// for named targets.
 func NewProxy(targetList []*url.URL) *Proxy {
+	return NewProxyWithTargets(NewTargets(targetList))
+}
+
+func NewProxyWithTargets(targetList []*Target) *Proxy {
 	return &Proxy{
-		TargetList:   targetList,
-		BodyFallback: BodyFallbackNone,
-		Transport:    http.DefaultTransport,
+		TargetList:      targetList,
+		BodyFallback:    BodyFallbackNone,
+		BodyBufferSize:  DefaultBodyBufferSize,
+		Order:           OrderConfig,
+		Strategy:        Strategy{Kind: StrategyAll},
+		Diff:            DiffNone,
+		UnhealthyAction: UnhealthyRequest,
+		Transport:       http.DefaultTransport,
+	}
+}
+
+// SetMetrics sets m to p and to the proxies of its routes.
+func (p *Proxy) SetMetrics(m *Metrics) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	p.Metrics = m
+	for _, r := range p.Routes {
+		r.Proxy.SetMetrics(m)
+	}
+}
+
+// Close stops the health checkers of p and of its routes.
+func (p *Proxy) Close() error {
+	p.m.RLock()
+	defer p.m.RUnlock()
+	if p.HealthChecker != nil {
+		p.HealthChecker.Stop()
+	}
+	for _, r := range p.Routes {
+		r.Proxy.Close()
 	}
+	return nil
+}
+
+// Reload replaces every setting of p with those of np at once, and stops
+// the health checkers replaced. Transport and Metrics are kept, and the
+// routes of np get the metrics of p.
+func (p *Proxy) Reload(np *Proxy) {
+	np.m.RLock()
+	defer np.m.RUnlock()
+
+	p.m.Lock()
+	oldChecker, oldRoutes := p.HealthChecker, p.Routes
+	p.TargetList = np.TargetList
+	p.BodyFallback = np.BodyFallback
+	p.BodyBufferSize = np.BodyBufferSize
+	p.Timeout = np.Timeout
+	p.PerTargetTimeout = np.PerTargetTimeout
+	p.Timing = np.Timing
+	p.Headers = np.Headers
+	p.HeaderAllowList = np.HeaderAllowList
+	p.HeaderDenyList = np.HeaderDenyList
+	p.Order = np.Order
+	p.Strategy = np.Strategy
+	p.Diff = np.Diff
+	p.DiffIgnorePaths = np.DiffIgnorePaths
+	p.Consensus = np.Consensus
+	p.MaxConcurrency = np.MaxConcurrency
+	p.Semaphore = np.Semaphore
+	p.RateLimit = np.RateLimit
+	p.HealthChecker = np.HealthChecker
+	p.UnhealthyAction = np.UnhealthyAction
+	p.NewTarget = np.NewTarget
+	p.Routes = np.Routes
+	for _, r := range p.Routes {
+		r.Proxy.SetMetrics(p.Metrics)
+	}
+	p.m.Unlock()
+
+	if oldChecker != nil {
+		oldChecker.Stop()
+	}
+	for _, r := range oldRoutes {
+		r.Proxy.Close()
+	}
+}
+
+// Targets returns a copy of TargetList.
+func (p *Proxy) Targets() []*Target {
+	p.m.RLock()
+	defer p.m.RUnlock()
+	return append([]*Target(nil), p.TargetList...)
+}
+
+// NewTargetWith builds a target with the settings of p by NewTarget, or
+// a plain one when NewTarget is not set.
+func (p *Proxy) NewTargetWith(name string, u *url.URL, labels map[string]string) *Target {
+	p.m.RLock()
+	newTarget := p.NewTarget
+	p.m.RUnlock()
+	if newTarget == nil {
+		return &Target{Name: name, URL: u, Labels: labels}
+	}
+	return newTarget(name, u, labels)
+}
+
+// AddTarget appends t to TargetList and to the health checker. Like in
+// config, names must be unique, and so must urls of unnamed targets.
+func (p *Proxy) AddTarget(t *Target) error {
+	p.m.Lock()
+	defer p.m.Unlock()
+	for _, other := range p.TargetList {
+		if t.Name != "" && other.Name == t.Name {
+			return fmt.Errorf("duplicate name:%v", t.Name)
+		}
+		if t.Name == "" && other.Name == "" && other.String() == t.String() {
+			return fmt.Errorf("duplicate url:%v. give each a name to list it more than once", t)
+		}
+	}
+	targets := make([]*Target, 0, len(p.TargetList)+1)
+	p.TargetList = append(append(targets, p.TargetList...), t)
+	if p.HealthChecker != nil {
+		p.HealthChecker.Add(t)
+	}
+	return nil
+}
+
+// RemoveTarget removes the first target whose name or url is id from
+// TargetList and from the health checker. It reports whether one was
+// found.
+func (p *Proxy) RemoveTarget(id string) (*Target, bool) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	i := findTarget(p.TargetList, id)
+	if i < 0 {
+		return nil, false
+	}
+	t := p.TargetList[i]
+	targets := make([]*Target, 0, len(p.TargetList)-1)
+	p.TargetList = append(append(targets, p.TargetList[:i]...), p.TargetList[i+1:]...)
+	if p.HealthChecker != nil {
+		p.HealthChecker.Remove(t)
+	}
+	return t, true
+}
+
+// DrainTarget stops sending new requests to the first target whose name
+// or url is id. Requests in flight are not affected. It reports whether
+// one was found.
+func (p *Proxy) DrainTarget(id string) (*Target, bool) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	i := findTarget(p.TargetList, id)
+	if i < 0 {
+		return nil, false
+	}
+	p.TargetList[i].draining = true
+	return p.TargetList[i], true
+}
+
+// Route returns the proxy of the route named name, or at index name for
+// unnamed routes. Empty name returns p when it has no routes, since
+// TargetList of p is not used otherwise.
+func (p *Proxy) Route(name string) (*Proxy, bool) {
+	p.m.RLock()
+	defer p.m.RUnlock()
+	if name == "" {
+		return p, len(p.Routes) == 0
+	}
+	for _, r := range p.Routes {
+		if r.Name == name {
+			return r.Proxy, true
+		}
+	}
+	if i, err := strconv.Atoi(name); err == nil && i >= 0 && i < len(p.Routes) {
+		return p.Routes[i].Proxy, true
+	}
+	return nil, false
+}
+
+func findTarget(targets []*Target, id string) int {
+	for i, t := range targets {
+		if t.Name != "" && t.Name == id {
+			return i
+		}
+	}
+	for i, t := range targets {
+		if t.String() == id {
+			return i
+		}
+	}
+	return -1
 }
 
 type JsonItem struct {
-	Target     string          `json:"target"`
-	Body       json.RawMessage `json:"body"`
-	StatusCode int             `json:"status_code"`
+	// Index is the position of the target in TargetList.
+	Index      int               `json:"index"`
+	Target     string            `json:"target"`
+	Name       string            `json:"name,omitempty"`
+	Labels     map[string]string `json:"labels,omitempty"`
+	Body       json.RawMessage   `json:"body"`
+	StatusCode int               `json:"status_code"`
+	Error      *JsonError        `json:"error,omitempty"`
+	Timing     *JsonTiming       `json:"timing,omitempty"`
+	Headers    http.Header       `json:"headers,omitempty"`
+	// Skipped is set when the target was not requested. Error has the
+	// same kind.
+	Skipped ErrorKind `json:"skipped,omitempty"`
+	// Attempts is the number of requests sent, set when the target has a
+	// RetryPolicy.
+	Attempts int `json:"attempts,omitempty"`
+
+	duration time.Duration
 }
 
 func (p *Proxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
-	p.M.RLock()
+	// every setting is read at once so that a request never mixes old
+	// and new config
+	p.m.RLock()
+	routes := p.Routes
+	if len(routes) > 0 {
+		p.m.RUnlock()
+		route := matchRoute(routes, req.URL.Path)
+		if route == nil {
+			log.Debugf("no route for path:%v", req.URL.Path)
+			writeNoRoute(rw, req)
+			return
+		}
+		log.Debugf("route:%v path:%v", route.Name, req.URL.Path)
+		route.Proxy.ServeHTTP(rw, req)
+		return
+	}
+	bufferSize := p.BodyBufferSize
+	timeout := p.Timeout
+	perTargetTimeout := p.PerTargetTimeout
+	maxConcurrency := p.MaxConcurrency
+	rateLimit := p.RateLimit
+	opts := p.requestOptions(req)
+	targetReqs := p.targetRequests()
+	p.m.RUnlock()
+	req = stripReservedQuery(req)
+
+	// the context is cancelled when the client goes away
+	ctx, cancel := context.WithCancel(req.Context())
+	defer cancel()
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
 
-	itemChan := make(chan *JsonItem, len(p.TargetList))
-	var wg sync.WaitGroup
+	if opts.metrics != nil {
+		opts.metrics.fanOutStarted()
+		defer opts.metrics.fanOutDone()
+	}
+
+	if rateLimit != nil {
+		if ok, err := rateLimit.Wait(ctx); !ok && err == nil {
+			for _, treq := range targetReqs {
+				treq.skip = &JsonError{Message: "rate limit exceeded", Kind: ErrorKindRateLimited}
+			}
+		}
+	}
+
+	body, err := newBufferedBody(req.Body, bufferSize)
+	if err != nil {
+		log.Errorf("read request body err:%v", err)
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	defer body.Close()
+
+	for _, treq := range targetReqs {
+		outreq := cloneRequest(req).WithContext(ctx)
+		outreq.URL = director(treq.target, req)
+		treq.target.applyHeaders(outreq)
+		setRequestBody(outreq, body)
+		treq.req = outreq
+	}
 
-	targetReqMap := map[string]*http.Request{}
+	itemChan := p.fanOut(targetReqs, perTargetTimeout, maxConcurrency, opts)
+	itemChan = applyStrategy(itemChan, targetReqs, opts.strategy, cancel)
 
-	for _, target := range p.TargetList {
-		outreq := cloneRequest(req)
-		outreq.URL = director(target, req)
-		targetReqMap[target.String()] = outreq
+	switch opts.format {
+	case FormatNDJSON:
+		writeNDJSON(rw, itemChan)
+	case FormatSSE:
+		writeSSE(rw, itemChan)
+	default:
+		writeJSON(rw, itemChan, len(targetReqs), opts)
 	}
+}
 
-	p.M.RUnlock()
+// targetRequests returns one targetRequest without req for every target
+// to send to. Draining targets are left out, and so are unhealthy ones
+// unless they are to be reported. The caller must hold p.m.
+func (p *Proxy) targetRequests() []*targetRequest {
+	targetReqs := make([]*targetRequest, 0, len(p.TargetList))
+	for i, target := range p.TargetList {
+		if target.draining {
+			continue
+		}
+		treq := &targetRequest{
+			index:  i,
+			target: target,
+		}
+		if p.HealthChecker != nil && !p.HealthChecker.Healthy(target) {
+			switch p.UnhealthyAction {
+			case UnhealthySkip:
+				log.Debugf("skip unhealthy target:%v", target)
+				continue
+			case UnhealthyReport:
+				treq.skip = &JsonError{Message: "target is unhealthy", Kind: ErrorKindUnhealthy}
+			}
+		}
+		targetReqs = append(targetReqs, treq)
+	}
+	return targetReqs
+}
+
+// fanOut sends every request concurrently, at most maxConcurrency at a
+// time when it is positive. Each item is sent to the returned channel as
+// soon as its target is done, and the channel is closed after the last one.
+func (p *Proxy) fanOut(targetReqs []*targetRequest, perTargetTimeout time.Duration, maxConcurrency int, opts requestOptions) <-chan *JsonItem {
+	itemChan := make(chan *JsonItem, len(targetReqs))
+
+	workers := len(targetReqs)
+	if maxConcurrency > 0 && maxConcurrency < workers {
+		workers = maxConcurrency
+	}
 
-	for target, req := range targetReqMap {
+	treqChan := make(chan *targetRequest, len(targetReqs))
+	for _, treq := range targetReqs {
+		treqChan <- treq
+	}
+	close(treqChan)
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
 		wg.Add(1)
-		go func(target string, req *http.Request) {
+		go func() {
 			defer wg.Done()
+			for treq := range treqChan {
+				item := p.serveTargetWithTimeout(treq, perTargetTimeout, opts)
+				if opts.metrics != nil {
+					opts.metrics.observeItem(item)
+				}
+				itemChan <- item
+			}
+		}()
+	}
 
-			log.Debugf("target:%v request url:%v", target, req.URL)
+	go func() {
+		wg.Wait()
+		close(itemChan)
+	}()
 
-			res, err := p.Transport.RoundTrip(req)
-			if err != nil {
-				log.Errorf("round trip err:%v target:%v", err, target)
-				return
-			}
-			defer res.Body.Close()
+	return itemChan
+}
 
-			body, err := p.responseBodyToJsonBody(res)
+func (p *Proxy) serveTargetWithTimeout(treq *targetRequest, perTargetTimeout time.Duration, opts requestOptions) *JsonItem {
+	if perTargetTimeout > 0 {
+		ctx, cancel := context.WithTimeout(treq.req.Context(), perTargetTimeout)
+		defer cancel()
+		treq.req = treq.req.WithContext(ctx)
+	}
+	return p.serveTarget(treq, opts)
+}
+
+// targetRequest is the cloned request for the target at index of TargetList.
+// When skip is set the request is not sent and skip is reported instead.
+type targetRequest struct {
+	index  int
+	target *Target
+	req    *http.Request
+	skip   *JsonError
+}
 
+// newItem returns an item identifying the target of treq.
+func (treq *targetRequest) newItem() *JsonItem {
+	return &JsonItem{
+		Index:  treq.index,
+		Target: treq.target.String(),
+		Name:   treq.target.Name,
+		Labels: treq.target.Labels,
+	}
+}
+
+// skip marks the item as not requested because of err.
+func (item *JsonItem) skip(err *JsonError) {
+	item.Skipped = err.Kind
+	item.Error = err
+}
+
+// serveTarget sends the request to its target and always returns an item for it.
+func (p *Proxy) serveTarget(treq *targetRequest, opts requestOptions) *JsonItem {
+	target, req := treq.target, treq.req
+	log.Debugf("target:%v request url:%v", target, req.URL)
+
+	item := treq.newItem()
+	if treq.skip != nil {
+		item.skip(treq.skip)
+		return item
+	}
+	if target.Breaker != nil && !target.Breaker.Allow() {
+		item.skip(&JsonError{Message: "circuit breaker is open", Kind: ErrorKindCircuitOpen})
+		return item
+	}
+	if target.RateLimit != nil {
+		if ok, err := target.RateLimit.Wait(req.Context()); !ok {
+			if target.Breaker != nil {
+				target.Breaker.Abort()
+			}
 			if err != nil {
-				log.Errorf("%v target:%v", err, target)
-				return
+				item.Error = newJsonError(err)
+			} else {
+				item.skip(&JsonError{Message: "rate limit exceeded", Kind: ErrorKindRateLimited})
 			}
-
-			item := &JsonItem{
-				Target:     target,
-				StatusCode: res.StatusCode,
-				Body:       body,
+			return item
+		}
+	}
+	if opts.semaphore != nil {
+		if err := opts.semaphore.Acquire(req.Context()); err != nil {
+			if target.Breaker != nil {
+				target.Breaker.Abort()
 			}
+			item.Error = newJsonError(err)
+			return item
+		}
+		defer opts.semaphore.Release()
+	}
 
-			itemChan <- item
-		}(target, req)
+	start := time.Now()
+	defer func() {
+		item.duration = time.Since(start)
+	}()
+
+	var recorder *timingRecorder
+	if opts.timing {
+		recorder = newTimingRecorder()
+		req = recorder.withTrace(req)
+		defer func() {
+			item.Timing = recorder.finish()
+		}()
 	}
 
-	wg.Wait()
-	close(itemChan)
+	res, err := p.roundTrip(target, req, item, opts.metrics)
+	if err != nil {
+		log.Errorf("round trip err:%v target:%v", err, target)
+		item.Error = newJsonError(err)
+		return item
+	}
+	defer res.Body.Close()
 
-	items := make([]*JsonItem, 0, len(itemChan))
-	for item := range itemChan {
-		items = append(items, item)
+	item.StatusCode = res.StatusCode
+	if opts.headers != nil {
+		item.Headers = opts.headers.apply(res.Header)
 	}
 
-	var b bytes.Buffer
-	if err := json.NewEncoder(&b).Encode(items); err != nil {
-		log.Errorf("json encode err:%v", err)
-		rw.WriteHeader(http.StatusInternalServerError)
-		return
+	body, err := responseBodyToJsonBody(res, opts.bodyFallback)
+	if err != nil {
+		log.Errorf("%v target:%v", err, target)
+		item.Error = newJsonError(err)
+		return item
 	}
+	item.Body = body
 
-	rw.Header().Set("Content-Type", "application/json")
-	rw.WriteHeader(http.StatusOK)
-	rw.Write(b.Bytes())
+	return item
 }
 
-func (p *Proxy) responseBodyToJsonBody(res *http.Response) (body []byte, err error) {
+func responseBodyToJsonBody(res *http.Response, bodyFallback BodyFallback) (body []byte, err error) {
 
 	var contentType string
 
@@ -130,7 +576,7 @@ func (p *Proxy) responseBodyToJsonBody(res *http.Response) (body []byte, err err
 	case strings.Contains(contentType, "application/json"):
 		body, err = ioutil.ReadAll(res.Body)
 		if err != nil {
-			err = fmt.Errorf("read body err:%v", err)
+			err = &TargetError{Kind: ErrorKindReadBody, Err: fmt.Errorf("read body err:%w", err)}
 			return
 		}
 		var tmp interface{}
@@ -143,7 +589,7 @@ func (p *Proxy) responseBodyToJsonBody(res *http.Response) (body []byte, err err
 	}
 
 fallback:
-	switch p.BodyFallback {
+	switch bodyFallback {
 	case BodyFallbackNone:
 		body = []byte(`""`)
 		return
@@ -152,17 +598,17 @@ fallback:
 			body, err = ioutil.ReadAll(res.Body)
 		}
 		if err != nil {
-			return nil, fmt.Errorf("read body err:%v", err)
+			return nil, &TargetError{Kind: ErrorKindReadBody, Err: fmt.Errorf("read body err:%w", err)}
 		}
 		var b bytes.Buffer
 		if _err := json.NewEncoder(&b).Encode(body); _err != nil {
-			err = fmt.Errorf("fallback json encode err:%v", _err)
+			err = &TargetError{Kind: ErrorKindDecode, Err: fmt.Errorf("fallback json encode err:%v", _err)}
 			return
 		}
 		body = b.Bytes()
 		return
 	default:
-		err = fmt.Errorf("not supported fallback type:%v", p.BodyFallback)
+		err = &TargetError{Kind: ErrorKindDecode, Err: fmt.Errorf("not supported fallback type:%v", bodyFallback)}
 		return
 	}
 }
@@ -206,8 +652,24 @@ func cloneRequest(req *http.Request) *http.Request {
 	return outreq
 }
 
+// give the cloned request its own reader over the buffered body
+func setRequestBody(outreq *http.Request, body *bufferedBody) {
+	outreq.TransferEncoding = nil
+	outreq.ContentLength = body.Size()
+	if body.Size() == 0 {
+		outreq.Body = nil
+		outreq.GetBody = nil
+		return
+	}
+	outreq.Body = body.NewReader()
+	outreq.GetBody = func() (io.ReadCloser, error) {
+		return body.NewReader(), nil
+	}
+}
+
 // create url from oridinal request and target
-func director(target *url.URL, req *http.Request) *url.URL {
+func director(t *Target, req *http.Request) *url.URL {
+	target := t.URL
 	targetQuery := target.RawQuery
 
 	var url url.URL
@@ -215,12 +677,19 @@ func director(target *url.URL, req *http.Request) *url.URL {
 
 	url.Scheme = target.Scheme
 	url.Host = target.Host
+	if t.Rewrite != nil {
+		url.Path = t.Rewrite.rewritePath(url.Path)
+		url.RawPath = ""
+	}
 	url.Path = singleJoiningSlash(target.Path, url.Path)
 	if targetQuery == "" || url.RawQuery == "" {
 		url.RawQuery = targetQuery + url.RawQuery
 	} else {
 		url.RawQuery = targetQuery + "&" + url.RawQuery
 	}
+	if t.Rewrite != nil {
+		url.RawQuery = t.Rewrite.rewriteQuery(url.RawQuery)
+	}
 
 	return &url
 }
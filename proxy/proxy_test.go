@@ -1,7 +1,9 @@
 package proxy
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
@@ -9,8 +11,12 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/url"
-	"sort"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 type bodyFallbackSpec struct {
@@ -39,11 +45,11 @@ func TestProxyValidJson(t *testing.T) {
 	specs := []bodyFallbackSpec{
 		{
 			BodyFallback: BodyFallbackNone,
-			Expected:     fmt.Sprintf("[{\"target\":\"%v\",\"body\":%v,\"status_code\":%v}]\n", backend.URL, string(content), 200),
+			Expected:     fmt.Sprintf("[{\"index\":0,\"target\":\"%v\",\"body\":%v,\"status_code\":%v}]\n", backend.URL, string(content), 200),
 		},
 		{
 			BodyFallback: BodyFallbackJsonEncode,
-			Expected:     fmt.Sprintf("[{\"target\":\"%v\",\"body\":%v,\"status_code\":%v}]\n", backend.URL, string(content), 200),
+			Expected:     fmt.Sprintf("[{\"index\":0,\"target\":\"%v\",\"body\":%v,\"status_code\":%v}]\n", backend.URL, string(content), 200),
 		},
 	}
 
@@ -88,11 +94,11 @@ func TestProxyInvalidJson(t *testing.T) {
 	specs := []bodyFallbackSpec{
 		{
 			BodyFallback: BodyFallbackNone,
-			Expected:     fmt.Sprintf("[{\"target\":\"%v\",\"body\":\"%v\",\"status_code\":%v}]\n", backend.URL, "", 200),
+			Expected:     fmt.Sprintf("[{\"index\":0,\"target\":\"%v\",\"body\":\"%v\",\"status_code\":%v}]\n", backend.URL, "", 200),
 		},
 		{
 			BodyFallback: BodyFallbackJsonEncode,
-			Expected:     fmt.Sprintf("[{\"target\":\"%v\",\"body\":\"%v\",\"status_code\":%v}]\n", backend.URL, base64.StdEncoding.EncodeToString(invalidJson), 200),
+			Expected:     fmt.Sprintf("[{\"index\":0,\"target\":\"%v\",\"body\":\"%v\",\"status_code\":%v}]\n", backend.URL, base64.StdEncoding.EncodeToString(invalidJson), 200),
 		},
 	}
 
@@ -133,11 +139,11 @@ func TestProxyEmptyBody(t *testing.T) {
 	specs := []bodyFallbackSpec{
 		{
 			BodyFallback: BodyFallbackNone,
-			Expected:     fmt.Sprintf("[{\"target\":\"%v\",\"body\":\"%v\",\"status_code\":%v}]\n", backend.URL, "", 200),
+			Expected:     fmt.Sprintf("[{\"index\":0,\"target\":\"%v\",\"body\":\"%v\",\"status_code\":%v}]\n", backend.URL, "", 200),
 		},
 		{
 			BodyFallback: BodyFallbackJsonEncode,
-			Expected:     fmt.Sprintf("[{\"target\":\"%v\",\"body\":\"%v\",\"status_code\":%v}]\n", backend.URL, "", 200),
+			Expected:     fmt.Sprintf("[{\"index\":0,\"target\":\"%v\",\"body\":\"%v\",\"status_code\":%v}]\n", backend.URL, "", 200),
 		},
 	}
 
@@ -181,11 +187,11 @@ func TestProxyNotJsonContent(t *testing.T) {
 	specs := []bodyFallbackSpec{
 		{
 			BodyFallback: BodyFallbackNone,
-			Expected:     fmt.Sprintf("[{\"target\":\"%v\",\"body\":\"%v\",\"status_code\":%v}]\n", backend.URL, "", 404),
+			Expected:     fmt.Sprintf("[{\"index\":0,\"target\":\"%v\",\"body\":\"%v\",\"status_code\":%v}]\n", backend.URL, "", 404),
 		},
 		{
 			BodyFallback: BodyFallbackJsonEncode,
-			Expected:     fmt.Sprintf("[{\"target\":\"%v\",\"body\":\"%v\",\"status_code\":%v}]\n", backend.URL, base64.StdEncoding.EncodeToString(content), 404),
+			Expected:     fmt.Sprintf("[{\"index\":0,\"target\":\"%v\",\"body\":\"%v\",\"status_code\":%v}]\n", backend.URL, base64.StdEncoding.EncodeToString(content), 404),
 		},
 	}
 
@@ -242,38 +248,50 @@ func TestProxyDownHost(t *testing.T) {
 		targetList = append(targetList, url)
 	}
 
-	specs := []bodyFallbackSpec{
-		{
-			BodyFallback: BodyFallbackNone,
-			Expected:     fmt.Sprintf("[{\"target\":\"%v\",\"body\":\"%v\",\"status_code\":%v}]\n", backend1.URL, "", 404),
-		},
-	}
+	proxy := NewProxy(targetList)
+	proxy.BodyFallback = BodyFallbackNone
 
-	for _, spec := range specs {
-		proxy := NewProxy(targetList)
-		proxy.BodyFallback = spec.BodyFallback
+	frontend := httptest.NewServer(proxy)
+	defer frontend.Close()
 
-		frontend := httptest.NewServer(proxy)
-		defer frontend.Close()
+	req, _ := http.NewRequest("GET", frontend.URL, nil)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
 
-		req, _ := http.NewRequest("GET", frontend.URL, nil)
-		res, err := http.DefaultClient.Do(req)
-		if err != nil {
-			t.Fatal(err)
-		}
-		defer res.Body.Close()
-		body, _ := ioutil.ReadAll(res.Body)
-		if spec.Expected != string(body) {
-			t.Errorf("should %v but got %v", spec.Expected, string(body))
-		}
+	var jsonItems []JsonItem
+	if err := json.NewDecoder(res.Body).Decode(&jsonItems); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(jsonItems) != 2 {
+		t.Fatalf("should %v but got %v", 2, len(jsonItems))
 	}
-}
 
-type JsonItems []JsonItem
+	down := jsonItems[1]
+	if down.Target != backend2.URL {
+		t.Errorf("should %v but got %v", backend2.URL, down.Target)
+	}
+	if down.Error == nil {
+		t.Fatalf("should have error but got nil")
+	}
+	if g, e := down.Error.Kind, ErrorKindConnectRefused; g != e {
+		t.Errorf("should %v but got %v", e, g)
+	}
 
-func (a JsonItems) Len() int           { return len(a) }
-func (a JsonItems) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
-func (a JsonItems) Less(i, j int) bool { return a[i].StatusCode < a[j].StatusCode }
+	up := jsonItems[0]
+	if up.Target != backend1.URL {
+		t.Errorf("should %v but got %v", backend1.URL, up.Target)
+	}
+	if up.StatusCode != 404 {
+		t.Errorf("should %v but got %v", 404, up.StatusCode)
+	}
+	if up.Error != nil {
+		t.Errorf("should nil but got %v", up.Error)
+	}
+}
 
 func TestProxyMultipleHost(t *testing.T) {
 	targetList := []*url.URL{}
@@ -325,7 +343,6 @@ func TestProxyMultipleHost(t *testing.T) {
 	if err := json.NewDecoder(res.Body).Decode(&jsonItems); err != nil {
 		t.Fatal(err)
 	}
-	sort.Sort(JsonItems(jsonItems))
 
 	expecteds := []JsonItem{
 		{
@@ -345,6 +362,9 @@ func TestProxyMultipleHost(t *testing.T) {
 	}
 
 	for i, expected := range expecteds {
+		if jsonItems[i].Index != i {
+			t.Errorf("should %v but got %v", i, jsonItems[i].Index)
+		}
 		if jsonItems[i].Target != expected.Target {
 			t.Errorf("should %v but got %v", expected.Target, jsonItems[i].Target)
 		}
@@ -356,3 +376,1310 @@ func TestProxyMultipleHost(t *testing.T) {
 		}
 	}
 }
+
+func TestProxyRequestBody(t *testing.T) {
+	type spec struct {
+		Method         string
+		Content        string
+		BodyBufferSize int64
+	}
+
+	specs := []spec{
+		{Method: "POST", Content: `{"config":"value"}`},
+		{Method: "PUT", Content: `{"config":"value"}`},
+		{Method: "PATCH", Content: `{"config":"value"}`},
+		{Method: "DELETE", Content: ""},
+		// spilled to temporary file
+		{Method: "POST", Content: `{"config":"spilled to temporary file"}`, BodyBufferSize: 4},
+	}
+
+	for _, spec := range specs {
+		targetList := []*url.URL{}
+
+		for i := 0; i < 3; i++ {
+			backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				body, err := ioutil.ReadAll(req.Body)
+				if err != nil {
+					t.Error(err)
+				}
+				if g, e := req.Method, spec.Method; g != e {
+					t.Errorf("got method %v but should %v", g, e)
+				}
+				if g, e := req.ContentLength, int64(len(spec.Content)); g != e {
+					t.Errorf("got content length %v but should %v", g, e)
+				}
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusOK)
+				json.NewEncoder(w).Encode(string(body))
+			}))
+			defer backend.Close()
+
+			url, err := url.Parse(backend.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			targetList = append(targetList, url)
+		}
+
+		proxy := NewProxy(targetList)
+		if spec.BodyBufferSize > 0 {
+			proxy.BodyBufferSize = spec.BodyBufferSize
+		}
+
+		frontend := httptest.NewServer(proxy)
+		defer frontend.Close()
+
+		req, _ := http.NewRequest(spec.Method, frontend.URL, bytes.NewBufferString(spec.Content))
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+
+		var jsonItems []JsonItem
+		if err := json.NewDecoder(res.Body).Decode(&jsonItems); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(jsonItems) != len(targetList) {
+			t.Errorf("should %v but got %v", len(targetList), len(jsonItems))
+		}
+
+		for _, item := range jsonItems {
+			var body string
+			if err := json.Unmarshal(item.Body, &body); err != nil {
+				t.Fatal(err)
+			}
+			if body != spec.Content {
+				t.Errorf("%v target:%v should %v but got %v", spec.Method, item.Target, spec.Content, body)
+			}
+		}
+	}
+}
+
+func TestProxyTimeout(t *testing.T) {
+	type spec struct {
+		Timeout          time.Duration
+		PerTargetTimeout time.Duration
+	}
+
+	specs := []spec{
+		{Timeout: 100 * time.Millisecond},
+		{PerTargetTimeout: 100 * time.Millisecond},
+		{Timeout: time.Minute, PerTargetTimeout: 100 * time.Millisecond},
+	}
+
+	for _, spec := range specs {
+		fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer fast.Close()
+
+		slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			select {
+			case <-req.Context().Done():
+			case <-time.After(10 * time.Second):
+			}
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer slow.Close()
+
+		targetList := []*url.URL{}
+		for _, backend := range []*httptest.Server{fast, slow} {
+			url, err := url.Parse(backend.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			targetList = append(targetList, url)
+		}
+
+		proxy := NewProxy(targetList)
+		proxy.Timeout = spec.Timeout
+		proxy.PerTargetTimeout = spec.PerTargetTimeout
+
+		frontend := httptest.NewServer(proxy)
+		defer frontend.Close()
+
+		start := time.Now()
+		req, _ := http.NewRequest("GET", frontend.URL, nil)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Errorf("response took %v", elapsed)
+		}
+
+		var jsonItems []JsonItem
+		if err := json.NewDecoder(res.Body).Decode(&jsonItems); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(jsonItems) != 2 {
+			t.Fatalf("should %v but got %v", 2, len(jsonItems))
+		}
+		if g, e := jsonItems[1].Target, slow.URL; g != e {
+			t.Errorf("should %v but got %v", e, g)
+		}
+		if jsonItems[1].Error == nil || jsonItems[1].Error.Kind != ErrorKindTimeout {
+			t.Errorf("should timeout but got %v", jsonItems[1].Error)
+		}
+		if g, e := jsonItems[0].StatusCode, http.StatusOK; g != e {
+			t.Errorf("should %v but got %v", e, g)
+		}
+	}
+}
+
+func TestProxyClientDisconnect(t *testing.T) {
+	started := make(chan struct{})
+	cancelled := make(chan struct{})
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		close(started)
+		select {
+		case <-req.Context().Done():
+			close(cancelled)
+		case <-time.After(10 * time.Second):
+		}
+	}))
+	defer backend.Close()
+
+	backendURL, err := url.Parse(backend.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proxy := NewProxy([]*url.URL{backendURL})
+	frontend := httptest.NewServer(proxy)
+	defer frontend.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequest("GET", frontend.URL, nil)
+	req = req.WithContext(ctx)
+
+	go func() {
+		<-started
+		cancel()
+	}()
+
+	if _, err := http.DefaultClient.Do(req); err == nil {
+		t.Fatal("should fail by cancel")
+	}
+
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Error("backend request was not cancelled")
+	}
+}
+
+func TestProxyTiming(t *testing.T) {
+	type spec struct {
+		Timing    bool
+		Query     string
+		HasTiming bool
+	}
+
+	specs := []spec{
+		{Timing: false, Query: "", HasTiming: false},
+		{Timing: true, Query: "", HasTiming: true},
+		{Timing: false, Query: "?_timing=1", HasTiming: true},
+		{Timing: false, Query: "?_timing", HasTiming: true},
+		{Timing: true, Query: "?_timing=false", HasTiming: false},
+	}
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		time.Sleep(10 * time.Millisecond)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer backend.Close()
+
+	backendURL, err := url.Parse(backend.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, spec := range specs {
+		proxy := NewProxy([]*url.URL{backendURL})
+		proxy.Timing = spec.Timing
+
+		frontend := httptest.NewServer(proxy)
+		defer frontend.Close()
+
+		req, _ := http.NewRequest("GET", frontend.URL+spec.Query, nil)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+
+		var jsonItems []JsonItem
+		if err := json.NewDecoder(res.Body).Decode(&jsonItems); err != nil {
+			t.Fatal(err)
+		}
+		if len(jsonItems) != 1 {
+			t.Fatalf("should %v but got %v", 1, len(jsonItems))
+		}
+
+		timing := jsonItems[0].Timing
+		if g, e := timing != nil, spec.HasTiming; g != e {
+			t.Errorf("timing:%v query:%v should %v but got %v", spec.Timing, spec.Query, e, g)
+			continue
+		}
+		if timing == nil {
+			continue
+		}
+		if timing.Total < 10 {
+			t.Errorf("total should be at least 10ms but got %v", timing.Total)
+		}
+		if timing.FirstByte <= 0 || timing.FirstByte > timing.Total {
+			t.Errorf("first byte should be in (0, %v] but got %v", timing.Total, timing.FirstByte)
+		}
+	}
+}
+
+func TestProxyHeaders(t *testing.T) {
+	type spec struct {
+		Headers   bool
+		AllowList []string
+		DenyList  []string
+		Query     string
+		Expected  http.Header
+	}
+
+	specs := []spec{
+		{
+			Headers:  false,
+			Expected: nil,
+		},
+		{
+			Headers:   true,
+			AllowList: []string{"etag", "X-Version"},
+			Expected:  http.Header{"Etag": {`"abc"`}, "X-Version": {"1.2.3"}},
+		},
+		{
+			Headers:  true,
+			DenyList: []string{"Date", "Content-Length", "Content-Type", "Etag"},
+			Expected: http.Header{"X-Version": {"1.2.3"}, "Cache-Control": {"no-cache"}},
+		},
+		{
+			Headers:   false,
+			AllowList: []string{"Cache-Control"},
+			Query:     "?_headers=1",
+			Expected:  http.Header{"Cache-Control": {"no-cache"}},
+		},
+		{
+			Headers:   true,
+			AllowList: []string{"Cache-Control"},
+			Query:     "?_headers=0",
+			Expected:  nil,
+		},
+		{
+			Headers:   false,
+			AllowList: []string{"Cache-Control"},
+			DenyList:  []string{"Etag"},
+			Query:     "?_headers=X-Version,Etag",
+			Expected:  http.Header{"X-Version": {"1.2.3"}},
+		},
+	}
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if _, ok := req.URL.Query()[QueryHeaders]; ok {
+			t.Errorf("%v should not be sent to target", QueryHeaders)
+		}
+		w.Header().Set("ETag", `"abc"`)
+		w.Header().Set("X-Version", "1.2.3")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer backend.Close()
+
+	backendURL, err := url.Parse(backend.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, spec := range specs {
+		proxy := NewProxy([]*url.URL{backendURL})
+		proxy.Headers = spec.Headers
+		proxy.HeaderAllowList = spec.AllowList
+		proxy.HeaderDenyList = spec.DenyList
+
+		frontend := httptest.NewServer(proxy)
+		defer frontend.Close()
+
+		req, _ := http.NewRequest("GET", frontend.URL+spec.Query, nil)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+
+		var jsonItems []JsonItem
+		if err := json.NewDecoder(res.Body).Decode(&jsonItems); err != nil {
+			t.Fatal(err)
+		}
+		if len(jsonItems) != 1 {
+			t.Fatalf("should %v but got %v", 1, len(jsonItems))
+		}
+		if g, e := jsonItems[0].Headers, spec.Expected; !reflect.DeepEqual(g, e) {
+			t.Errorf("%d. should %v but got %v", i, e, g)
+		}
+	}
+}
+
+func TestProxyOrder(t *testing.T) {
+	type backendSpec struct {
+		StatusCode int
+		Sleep      time.Duration
+	}
+
+	backendSpecs := []backendSpec{
+		{StatusCode: 500, Sleep: 60 * time.Millisecond},
+		{StatusCode: 200, Sleep: 0},
+		{StatusCode: 404, Sleep: 30 * time.Millisecond},
+	}
+
+	targetList := []*url.URL{}
+	for _, bs := range backendSpecs {
+		bs := bs
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			time.Sleep(bs.Sleep)
+			w.WriteHeader(bs.StatusCode)
+		}))
+		defer backend.Close()
+
+		url, err := url.Parse(backend.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		targetList = append(targetList, url)
+	}
+
+	specs := []struct {
+		Order    Order
+		Query    string
+		Expected []int
+	}{
+		{Order: OrderConfig, Expected: []int{0, 1, 2}},
+		{Order: OrderStatus, Expected: []int{1, 2, 0}},
+		{Order: OrderLatency, Expected: []int{1, 2, 0}},
+		{Order: OrderConfig, Query: "?_order=status", Expected: []int{1, 2, 0}},
+		{Order: OrderStatus, Query: "?_order=config", Expected: []int{0, 1, 2}},
+	}
+
+	for _, spec := range specs {
+		proxy := NewProxy(targetList)
+		proxy.Order = spec.Order
+
+		frontend := httptest.NewServer(proxy)
+		defer frontend.Close()
+
+		req, _ := http.NewRequest("GET", frontend.URL+spec.Query, nil)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+
+		var jsonItems []JsonItem
+		if err := json.NewDecoder(res.Body).Decode(&jsonItems); err != nil {
+			t.Fatal(err)
+		}
+
+		got := []int{}
+		for _, item := range jsonItems {
+			got = append(got, item.Index)
+		}
+		if !reflect.DeepEqual(got, spec.Expected) {
+			t.Errorf("order:%v query:%v should %v but got %v", spec.Order, spec.Query, spec.Expected, got)
+		}
+	}
+}
+
+func TestProxyDuplicateTarget(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer backend.Close()
+
+	backendURL, err := url.Parse(backend.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proxy := NewProxy([]*url.URL{backendURL, backendURL})
+	frontend := httptest.NewServer(proxy)
+	defer frontend.Close()
+
+	res, err := http.Get(frontend.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	var jsonItems []JsonItem
+	if err := json.NewDecoder(res.Body).Decode(&jsonItems); err != nil {
+		t.Fatal(err)
+	}
+	if len(jsonItems) != 2 {
+		t.Fatalf("should %v but got %v", 2, len(jsonItems))
+	}
+	for i, item := range jsonItems {
+		if item.Index != i {
+			t.Errorf("should %v but got %v", i, item.Index)
+		}
+	}
+}
+
+func TestProxyNDJSON(t *testing.T) {
+	type spec struct {
+		Query  string
+		Accept string
+	}
+
+	specs := []spec{
+		{Query: "?_format=ndjson"},
+		{Accept: "application/x-ndjson"},
+		{Accept: "text/html, application/x-ndjson;q=0.9"},
+	}
+
+	for _, spec := range specs {
+		release := make(chan struct{})
+
+		fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer fast.Close()
+
+		slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			select {
+			case <-release:
+			case <-time.After(10 * time.Second):
+			}
+			w.WriteHeader(http.StatusNotFound)
+		}))
+		defer slow.Close()
+
+		hung := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			select {
+			case <-req.Context().Done():
+			case <-time.After(10 * time.Second):
+			}
+		}))
+		defer hung.Close()
+
+		targetList := []*url.URL{}
+		for _, backend := range []*httptest.Server{slow, fast, hung} {
+			url, err := url.Parse(backend.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			targetList = append(targetList, url)
+		}
+
+		proxy := NewProxy(targetList)
+		proxy.PerTargetTimeout = 500 * time.Millisecond
+		frontend := httptest.NewServer(proxy)
+		defer frontend.Close()
+
+		req, _ := http.NewRequest("GET", frontend.URL+spec.Query, nil)
+		if spec.Accept != "" {
+			req.Header.Set("Accept", spec.Accept)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+
+		if g, e := res.Header.Get("Content-Type"), "application/x-ndjson"; g != e {
+			t.Errorf("should %v but got %v", e, g)
+		}
+
+		dec := json.NewDecoder(res.Body)
+
+		// the fast target arrives while the slow one is still waiting
+		var first JsonItem
+		if err := dec.Decode(&first); err != nil {
+			t.Fatal(err)
+		}
+		if g, e := first.Target, fast.URL; g != e {
+			t.Errorf("should %v but got %v", e, g)
+		}
+		close(release)
+
+		var second JsonItem
+		if err := dec.Decode(&second); err != nil {
+			t.Fatal(err)
+		}
+		if g, e := second.Target, slow.URL; g != e {
+			t.Errorf("should %v but got %v", e, g)
+		}
+
+		var third JsonItem
+		if err := dec.Decode(&third); err != nil {
+			t.Fatal(err)
+		}
+		if g, e := third.Target, hung.URL; g != e {
+			t.Errorf("should %v but got %v", e, g)
+		}
+
+		var last struct {
+			Summary JsonSummary `json:"summary"`
+		}
+		if err := dec.Decode(&last); err != nil {
+			t.Fatal(err)
+		}
+		expected := JsonSummary{Total: 3, Succeeded: 2, Failed: 1, TimedOut: []string{hung.URL}}
+		if !reflect.DeepEqual(last.Summary, expected) {
+			t.Errorf("should %v but got %v", expected, last.Summary)
+		}
+	}
+}
+
+func TestProxySSE(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"ping":"pong"}`))
+	}))
+	defer backend.Close()
+
+	backendURL, err := url.Parse(backend.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proxy := NewProxy([]*url.URL{backendURL})
+	frontend := httptest.NewServer(proxy)
+	defer frontend.Close()
+
+	for _, query := range []string{"", "?_format=sse"} {
+		req, _ := http.NewRequest("GET", frontend.URL+query, nil)
+		if query == "" {
+			req.Header.Set("Accept", "text/event-stream")
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+
+		if g, e := res.Header.Get("Content-Type"), "text/event-stream"; g != e {
+			t.Errorf("should %v but got %v", e, g)
+		}
+
+		body, _ := ioutil.ReadAll(res.Body)
+		expected := fmt.Sprintf("event: result\ndata: {\"index\":0,\"target\":\"%v\",\"body\":{\"ping\":\"pong\"},\"status_code\":200}\n\n"+
+			"event: done\ndata: {\"total\":1,\"succeeded\":1,\"failed\":0,\"timed_out\":[]}\n\n", backend.URL)
+		if string(body) != expected {
+			t.Errorf("should %v but got %v", expected, string(body))
+		}
+	}
+}
+
+func TestProxySSEClientDisconnect(t *testing.T) {
+	cancelled := make(chan struct{})
+
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer fast.Close()
+
+	hung := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		select {
+		case <-req.Context().Done():
+			close(cancelled)
+		case <-time.After(10 * time.Second):
+		}
+	}))
+	defer hung.Close()
+
+	targetList := []*url.URL{}
+	for _, backend := range []*httptest.Server{fast, hung} {
+		url, err := url.Parse(backend.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		targetList = append(targetList, url)
+	}
+
+	proxy := NewProxy(targetList)
+	frontend := httptest.NewServer(proxy)
+	defer frontend.Close()
+
+	req, _ := http.NewRequest("GET", frontend.URL+"?_format=sse", nil)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	line, err := bufio.NewReader(res.Body).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g, e := line, "event: result\n"; g != e {
+		t.Errorf("should %q but got %q", e, g)
+	}
+	res.Body.Close()
+
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Error("backend request was not cancelled")
+	}
+}
+
+func TestProxyStrategy(t *testing.T) {
+	type backendSpec struct {
+		Body  string
+		Sleep time.Duration
+	}
+
+	type spec struct {
+		Strategy Strategy
+		Query    string
+		Backends []backendSpec
+		// index of targets that should be canceled
+		Canceled []int
+	}
+
+	hung := 10 * time.Second
+
+	specs := []spec{
+		{
+			Strategy: Strategy{Kind: StrategyFirst},
+			Backends: []backendSpec{{`{"v":1}`, hung}, {`{"v":1}`, 0}, {`{"v":2}`, hung}},
+			Canceled: []int{0, 2},
+		},
+		{
+			Strategy: Strategy{Kind: StrategyQuorum, N: 2},
+			Backends: []backendSpec{{`{"v":1,"w":2}`, 0}, {`{"v":2}`, 0}, {`{"w":2, "v":1}`, 50 * time.Millisecond}, {`{"v":1}`, hung}},
+			Canceled: []int{3},
+		},
+		{
+			Strategy: Strategy{Kind: StrategyAnyN, N: 2},
+			Backends: []backendSpec{{`{"v":1}`, 0}, {`{"v":2}`, 0}, {`{"v":3}`, hung}},
+			Canceled: []int{2},
+		},
+		{
+			Strategy: Strategy{Kind: StrategyAll},
+			Query:    "?_strategy=first",
+			Backends: []backendSpec{{`{"v":1}`, 0}, {`{"v":2}`, hung}},
+			Canceled: []int{1},
+		},
+	}
+
+	for _, spec := range specs {
+		targetList := []*url.URL{}
+		for _, bs := range spec.Backends {
+			bs := bs
+			backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				select {
+				case <-req.Context().Done():
+					return
+				case <-time.After(bs.Sleep):
+				}
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusOK)
+				w.Write([]byte(bs.Body))
+			}))
+			defer backend.Close()
+
+			url, err := url.Parse(backend.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			targetList = append(targetList, url)
+		}
+
+		proxy := NewProxy(targetList)
+		proxy.Strategy = spec.Strategy
+
+		frontend := httptest.NewServer(proxy)
+		defer frontend.Close()
+
+		start := time.Now()
+		res, err := http.Get(frontend.URL + spec.Query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Errorf("%v: response took %v", spec.Strategy, elapsed)
+		}
+
+		var jsonItems []JsonItem
+		if err := json.NewDecoder(res.Body).Decode(&jsonItems); err != nil {
+			t.Fatal(err)
+		}
+		if len(jsonItems) != len(spec.Backends) {
+			t.Fatalf("%v: should %v but got %v", spec.Strategy, len(spec.Backends), len(jsonItems))
+		}
+
+		canceled := []int{}
+		for _, item := range jsonItems {
+			if item.Error != nil && item.Error.Kind == ErrorKindCanceled {
+				canceled = append(canceled, item.Index)
+			}
+		}
+		if !reflect.DeepEqual(canceled, spec.Canceled) {
+			t.Errorf("%v: should cancel %v but got %v", spec.Strategy, spec.Canceled, canceled)
+		}
+	}
+}
+
+func TestProxyDiff(t *testing.T) {
+	bodies := []string{`{"version":"1.0","time":1}`, `{"version":"1.1","time":2}`}
+
+	targetList := []*url.URL{}
+	for _, body := range bodies {
+		body := body
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(body))
+		}))
+		defer backend.Close()
+
+		url, err := url.Parse(backend.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		targetList = append(targetList, url)
+	}
+
+	specs := []struct {
+		Diff     DiffMode
+		Query    string
+		HasItems bool
+	}{
+		{Diff: DiffAlongside, HasItems: true},
+		{Diff: DiffReplace, HasItems: false},
+		{Diff: DiffNone, Query: "?_diff=1", HasItems: true},
+		{Diff: DiffNone, Query: "?_diff=replace", HasItems: false},
+	}
+
+	for _, spec := range specs {
+		proxy := NewProxy(targetList)
+		proxy.Diff = spec.Diff
+		proxy.DiffIgnorePaths = []string{"$.time"}
+
+		frontend := httptest.NewServer(proxy)
+		defer frontend.Close()
+
+		res, err := http.Get(frontend.URL + spec.Query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+
+		var output struct {
+			Items []JsonItem `json:"items"`
+			Diff  JsonDiff   `json:"diff"`
+		}
+		if err := json.NewDecoder(res.Body).Decode(&output); err != nil {
+			t.Fatal(err)
+		}
+
+		if g, e := len(output.Items) > 0, spec.HasItems; g != e {
+			t.Errorf("diff:%v query:%v should has items %v but got %v", spec.Diff, spec.Query, e, g)
+		}
+		if len(output.Diff.Paths) != 1 || output.Diff.Paths[0].Path != "$.version" {
+			t.Errorf("diff:%v query:%v should differ only at $.version but got %v", spec.Diff, spec.Query, output.Diff.Paths)
+		}
+	}
+}
+
+func TestProxyConsensus(t *testing.T) {
+	bodies := []string{`{"v":1}`, `{"v":2}`, `{"v":1}`}
+
+	targetList := []*url.URL{}
+	for _, body := range bodies {
+		body := body
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(body))
+		}))
+		defer backend.Close()
+
+		url, err := url.Parse(backend.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		targetList = append(targetList, url)
+	}
+
+	for _, query := range []string{"", "?_consensus=1"} {
+		proxy := NewProxy(targetList)
+		proxy.Consensus = query == ""
+
+		frontend := httptest.NewServer(proxy)
+		defer frontend.Close()
+
+		res, err := http.Get(frontend.URL + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+
+		if g, e := res.Header.Get(ConsensusHeader), string(ConsensusMajority); g != e {
+			t.Errorf("should %v but got %v", e, g)
+		}
+
+		var output struct {
+			Items     []JsonItem    `json:"items"`
+			Consensus JsonConsensus `json:"consensus"`
+		}
+		if err := json.NewDecoder(res.Body).Decode(&output); err != nil {
+			t.Fatal(err)
+		}
+		if output.Items != nil {
+			t.Errorf("should not have items but got %v", output.Items)
+		}
+		if g, e := string(output.Consensus.Body), `{"v":1}`; g != e {
+			t.Errorf("should %v but got %v", e, g)
+		}
+		if len(output.Consensus.Dissenters) != 1 || output.Consensus.Dissenters[0].Index != 1 {
+			t.Errorf("should dissent only index 1 but got %v", output.Consensus.Dissenters)
+		}
+	}
+}
+
+func TestProxyRoutes(t *testing.T) {
+	newBackend := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			json.NewEncoder(w).Encode(name)
+		}))
+	}
+
+	api := newBackend("api")
+	defer api.Close()
+	health := newBackend("health")
+	defer health.Close()
+
+	apiURL, _ := url.Parse(api.URL)
+	healthURL, _ := url.Parse(health.URL)
+
+	proxy := NewProxy(nil)
+	proxy.Routes = []*Route{
+		{Name: "health", Pattern: regexp.MustCompile(`^/health$`), Proxy: NewProxy([]*url.URL{healthURL})},
+		{Name: "api", Prefix: "/api/", Proxy: NewProxy([]*url.URL{apiURL})},
+	}
+
+	frontend := httptest.NewServer(proxy)
+	defer frontend.Close()
+
+	specs := []struct {
+		Path       string
+		StatusCode int
+		Body       string
+	}{
+		{Path: "/api/users", StatusCode: 200, Body: `"api"`},
+		{Path: "/health", StatusCode: 200, Body: `"health"`},
+		{Path: "/healthz", StatusCode: 404},
+		{Path: "/", StatusCode: 404},
+	}
+
+	for _, spec := range specs {
+		res, err := http.Get(frontend.URL + spec.Path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+
+		if g, e := res.StatusCode, spec.StatusCode; g != e {
+			t.Errorf("%v: should %v but got %v", spec.Path, e, g)
+		}
+
+		if spec.StatusCode == http.StatusNotFound {
+			var output struct {
+				Error JsonError `json:"error"`
+			}
+			if err := json.NewDecoder(res.Body).Decode(&output); err != nil {
+				t.Fatal(err)
+			}
+			if g, e := output.Error.Kind, ErrorKindNoRoute; g != e {
+				t.Errorf("%v: should %v but got %v", spec.Path, e, g)
+			}
+			continue
+		}
+
+		var jsonItems []JsonItem
+		if err := json.NewDecoder(res.Body).Decode(&jsonItems); err != nil {
+			t.Fatal(err)
+		}
+		if len(jsonItems) != 1 || string(jsonItems[0].Body) != spec.Body {
+			t.Errorf("%v: should %v but got %v", spec.Path, spec.Body, jsonItems)
+		}
+	}
+}
+
+func TestRouteMatch(t *testing.T) {
+	type spec struct {
+		Prefix   string
+		Path     string
+		Expected bool
+	}
+
+	specs := []spec{
+		{"/api", "/api", true},
+		{"/api", "/api/users", true},
+		{"/api", "/apiary", false},
+		{"/api", "/api2", false},
+		{"/api/", "/api/users", true},
+		{"/api/", "/api", false},
+		{"/", "/anything", true},
+		{"", "/anything", true},
+	}
+
+	for _, spec := range specs {
+		r := &Route{Prefix: spec.Prefix}
+		if g, e := r.Match(spec.Path), spec.Expected; g != e {
+			t.Errorf("prefix:%v path:%v should %v but got %v", spec.Prefix, spec.Path, e, g)
+		}
+	}
+}
+
+func TestProxyNamedTarget(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer backend.Close()
+
+	backendURL, err := url.Parse(backend.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	targets := []*Target{
+		{Name: "tokyo-1", URL: backendURL, Labels: map[string]string{"region": "tokyo", "version": "1.0"}},
+		{Name: "tokyo-2", URL: backendURL, Labels: map[string]string{"region": "tokyo", "version": "1.1"}},
+		{URL: backendURL},
+	}
+
+	proxy := NewProxyWithTargets(targets)
+	frontend := httptest.NewServer(proxy)
+	defer frontend.Close()
+
+	res, err := http.Get(frontend.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	var jsonItems []JsonItem
+	if err := json.NewDecoder(res.Body).Decode(&jsonItems); err != nil {
+		t.Fatal(err)
+	}
+	if len(jsonItems) != len(targets) {
+		t.Fatalf("should %v but got %v", len(targets), len(jsonItems))
+	}
+	for i, target := range targets {
+		if g, e := jsonItems[i].Target, backend.URL; g != e {
+			t.Errorf("should %v but got %v", e, g)
+		}
+		if g, e := jsonItems[i].Name, target.Name; g != e {
+			t.Errorf("should %v but got %v", e, g)
+		}
+		if g, e := jsonItems[i].Labels, target.Labels; !reflect.DeepEqual(g, e) {
+			t.Errorf("should %v but got %v", e, g)
+		}
+	}
+}
+
+func TestProxyHealthCheck(t *testing.T) {
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer healthy.Close()
+
+	var requested int32
+	unhealthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/health" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		atomic.AddInt32(&requested, 1)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer unhealthy.Close()
+
+	targets := NewTargets([]*url.URL{
+		func() *url.URL { u, _ := url.Parse(healthy.URL); return u }(),
+		func() *url.URL { u, _ := url.Parse(unhealthy.URL); return u }(),
+	})
+
+	checker := NewHealthChecker(targets, HealthCheck{Path: "/health", Interval: 10 * time.Millisecond, Fall: 1})
+	checker.Start()
+	defer checker.Stop()
+
+	for i := 0; checker.Healthy(targets[1]); i++ {
+		if i > 100 {
+			t.Fatal("target should become unhealthy")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !checker.Healthy(targets[0]) {
+		t.Fatal("target should stay healthy")
+	}
+
+	type spec struct {
+		Action   UnhealthyAction
+		Expected string
+	}
+
+	specs := []spec{
+		{
+			Action:   UnhealthySkip,
+			Expected: `[{"index":0,"target":"` + healthy.URL + `","body":"","status_code":200}]`,
+		},
+		{
+			Action:   UnhealthyReport,
+			Expected: `[{"index":0,"target":"` + healthy.URL + `","body":"","status_code":200},{"index":1,"target":"` + unhealthy.URL + `","body":null,"status_code":0,"error":{"message":"target is unhealthy","kind":"unhealthy"},"skipped":"unhealthy"}]`,
+		},
+	}
+
+	for _, spec := range specs {
+		proxy := NewProxyWithTargets(targets)
+		proxy.HealthChecker = checker
+		proxy.UnhealthyAction = spec.Action
+		frontend := httptest.NewServer(proxy)
+
+		res, err := http.Get(frontend.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		frontend.Close()
+
+		if g, e := strings.TrimSpace(string(b)), spec.Expected; g != e {
+			t.Errorf("%v: should %v but got %v", spec.Action, e, g)
+		}
+	}
+
+	if g := atomic.LoadInt32(&requested); g != 0 {
+		t.Errorf("unhealthy target should not be requested but got %v", g)
+	}
+}
+
+func TestProxyCircuitBreaker(t *testing.T) {
+	var requested int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&requested, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer backend.Close()
+
+	backendURL, err := url.Parse(backend.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := &Target{Name: "a", URL: backendURL}
+	target.Breaker = NewCircuitBreaker(target.Name, BreakerConfig{ConsecutiveFailures: 2, OpenTimeout: time.Hour})
+
+	proxy := NewProxyWithTargets([]*Target{target})
+	frontend := httptest.NewServer(proxy)
+	defer frontend.Close()
+
+	expected := []string{
+		`[{"index":0,"target":"` + backend.URL + `","name":"a","body":"","status_code":500}]`,
+		`[{"index":0,"target":"` + backend.URL + `","name":"a","body":"","status_code":500}]`,
+		`[{"index":0,"target":"` + backend.URL + `","name":"a","body":null,"status_code":0,"error":{"message":"circuit breaker is open","kind":"circuit_open"},"skipped":"circuit_open"}]`,
+	}
+	for i, e := range expected {
+		res, err := http.Get(frontend.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if g := strings.TrimSpace(string(b)); g != e {
+			t.Errorf("request %d: should %v but got %v", i, e, g)
+		}
+	}
+	if g, e := atomic.LoadInt32(&requested), int32(2); g != e {
+		t.Errorf("should %v but got %v", e, g)
+	}
+
+	rec := httptest.NewRecorder()
+	StatusHandler(proxy).ServeHTTP(rec, httptest.NewRequest("GET", "/_status", nil))
+	if g, e := strings.TrimSpace(rec.Body.String()), `{"targets":[{"index":0,"target":"`+backend.URL+`","name":"a","circuit":"open"}]}`; g != e {
+		t.Errorf("should %v but got %v", e, g)
+	}
+}
+
+func TestProxyRetry(t *testing.T) {
+	type spec struct {
+		Method   string
+		Policy   *RetryPolicy
+		Timeout  time.Duration
+		Expected string
+	}
+
+	specs := []spec{
+		{
+			Method:   "GET",
+			Policy:   &RetryPolicy{MaxAttempts: 5, BaseDelay: time.Millisecond},
+			Expected: `"body":{"ok":true},"status_code":200,"attempts":3`,
+		},
+		{
+			Method:   "GET",
+			Policy:   &RetryPolicy{MaxAttempts: 2, BaseDelay: time.Millisecond},
+			Expected: `"body":"","status_code":503,"attempts":2`,
+		},
+		{
+			Method:   "POST",
+			Policy:   &RetryPolicy{MaxAttempts: 5, BaseDelay: time.Millisecond},
+			Expected: `"body":"","status_code":503,"attempts":1`,
+		},
+		{
+			Method:   "POST",
+			Policy:   &RetryPolicy{MaxAttempts: 5, BaseDelay: time.Millisecond, NonIdempotent: true},
+			Expected: `"body":{"ok":true},"status_code":200,"attempts":3`,
+		},
+		{
+			// the first delay can not finish before the deadline
+			Method:   "GET",
+			Policy:   &RetryPolicy{MaxAttempts: 5, BaseDelay: time.Hour, MaxDelay: time.Hour},
+			Timeout:  time.Second,
+			Expected: `"body":"","status_code":503,"attempts":1`,
+		},
+		{
+			Method:   "GET",
+			Expected: `"body":"","status_code":503}`,
+		},
+	}
+
+	for _, spec := range specs {
+		var count int32
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if b, _ := ioutil.ReadAll(req.Body); string(b) != "body" && req.Method == "POST" {
+				t.Errorf("should body but got %s", b)
+			}
+			if atomic.AddInt32(&count, 1) < 3 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Content-Length", "11")
+			w.Write([]byte(`{"ok":true}`))
+		}))
+
+		backendURL, _ := url.Parse(backend.URL)
+		proxy := NewProxyWithTargets([]*Target{{URL: backendURL, Retry: spec.Policy}})
+		proxy.Timeout = spec.Timeout
+		frontend := httptest.NewServer(proxy)
+
+		req, _ := http.NewRequest(spec.Method, frontend.URL, strings.NewReader("body"))
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		frontend.Close()
+		backend.Close()
+
+		if g := string(b); !strings.Contains(g, spec.Expected) {
+			t.Errorf("%v %+v: should contain %v but got %v", spec.Method, spec.Policy, spec.Expected, g)
+		}
+	}
+}
+
+func TestProxyRateLimit(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer backend.Close()
+
+	backendURL, err := url.Parse(backend.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ok := `{"index":%d,"target":"` + backend.URL + `","name":"%s","body":"","status_code":200}`
+	limited := `{"index":%d,"target":"` + backend.URL + `","name":"%s","body":null,"status_code":0,"error":{"message":"rate limit exceeded","kind":"rate_limited"},"skipped":"rate_limited"}`
+
+	type spec struct {
+		RouteRateLimit *RateLimiter
+		Expected       []string
+	}
+
+	specs := []spec{
+		{
+			Expected: []string{
+				"[" + fmt.Sprintf(ok, 0, "legacy") + "," + fmt.Sprintf(ok, 1, "other") + "]",
+				"[" + fmt.Sprintf(limited, 0, "legacy") + "," + fmt.Sprintf(ok, 1, "other") + "]",
+			},
+		},
+		{
+			RouteRateLimit: NewRateLimiter(0.001, 1, 0),
+			Expected: []string{
+				"[" + fmt.Sprintf(ok, 0, "legacy") + "," + fmt.Sprintf(ok, 1, "other") + "]",
+				"[" + fmt.Sprintf(limited, 0, "legacy") + "," + fmt.Sprintf(limited, 1, "other") + "]",
+			},
+		},
+	}
+
+	for _, spec := range specs {
+		proxy := NewProxyWithTargets([]*Target{
+			{Name: "legacy", URL: backendURL, RateLimit: NewRateLimiter(0.001, 1, 0)},
+			{Name: "other", URL: backendURL},
+		})
+		proxy.RateLimit = spec.RouteRateLimit
+
+		for i, e := range spec.Expected {
+			rec := httptest.NewRecorder()
+			proxy.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+			if g := strings.TrimSpace(rec.Body.String()); g != e {
+				t.Errorf("request %d: should %v but got %v", i, e, g)
+			}
+		}
+	}
+}
+
+func TestProxyReload(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+
+	backendURL, _ := url.Parse(backend.URL)
+	proxy := NewProxy([]*url.URL{backendURL})
+	checker := NewHealthChecker(proxy.TargetList, HealthCheck{Interval: time.Hour})
+	checker.Start()
+	proxy.HealthChecker = checker
+
+	np := NewProxyWithTargets([]*Target{{Name: "a", URL: backendURL}})
+	np.BodyFallback = BodyFallbackJsonEncode
+	np.Order = OrderStatus
+	proxy.Reload(np)
+
+	rec := httptest.NewRecorder()
+	proxy.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if g, e := strings.TrimSpace(rec.Body.String()), `[{"index":0,"target":"`+backend.URL+`","name":"a","body":"b2s=","status_code":200}]`; g != e {
+		t.Errorf("should %v but got %v", e, g)
+	}
+	if g, e := proxy.Order, OrderStatus; g != e {
+		t.Errorf("should %v but got %v", e, g)
+	}
+	if proxy.HealthChecker != nil {
+		t.Errorf("health checker should be replaced")
+	}
+
+	select {
+	case <-checker.stop:
+	default:
+		t.Errorf("old health checker should be stopped")
+	}
+}
@@ -0,0 +1,93 @@
+package proxy
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// RateLimiter is a token bucket. Rate tokens are added per second up to
+// Burst. A request waits up to MaxWait for a token, otherwise it is
+// reported as rate_limited.
+type RateLimiter struct {
+	Rate    float64
+	Burst   int
+	MaxWait time.Duration
+
+	m      sync.Mutex
+	tokens float64
+	last   time.Time
+	now    func() time.Time
+}
+
+func NewRateLimiter(rate float64, burst int, maxWait time.Duration) *RateLimiter {
+	if burst <= 0 {
+		burst = 1
+	}
+	return &RateLimiter{
+		Rate:    rate,
+		Burst:   burst,
+		MaxWait: maxWait,
+		tokens:  float64(burst),
+		now:     time.Now,
+	}
+}
+
+// reserve takes a token and returns how long to wait for it. It reports
+// false and takes nothing when the wait would be longer than MaxWait.
+func (l *RateLimiter) reserve() (time.Duration, bool) {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	now := l.now()
+	if !l.last.IsZero() {
+		l.tokens += now.Sub(l.last).Seconds() * l.Rate
+		if l.tokens > float64(l.Burst) {
+			l.tokens = float64(l.Burst)
+		}
+	}
+	l.last = now
+
+	if l.tokens >= 1 {
+		l.tokens--
+		return 0, true
+	}
+	if l.Rate <= 0 {
+		return 0, false
+	}
+	wait := time.Duration((1 - l.tokens) / l.Rate * float64(time.Second))
+	if wait > l.MaxWait {
+		return 0, false
+	}
+	l.tokens--
+	return wait, true
+}
+
+func (l *RateLimiter) cancel() {
+	l.m.Lock()
+	defer l.m.Unlock()
+	l.tokens++
+}
+
+// Wait takes a token, waiting for it when needed. It reports false when
+// no token is available within MaxWait, and returns the error of ctx when
+// ctx is done first.
+func (l *RateLimiter) Wait(ctx context.Context) (bool, error) {
+	wait, ok := l.reserve()
+	if !ok {
+		return false, nil
+	}
+	if wait <= 0 {
+		return true, nil
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true, nil
+	case <-ctx.Done():
+		l.cancel()
+		return false, ctx.Err()
+	}
+}
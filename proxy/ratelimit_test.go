@@ -0,0 +1,55 @@
+package proxy
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterReserve(t *testing.T) {
+	now := time.Unix(0, 0)
+	l := NewRateLimiter(10, 2, 150*time.Millisecond)
+	l.now = func() time.Time { return now }
+
+	type step struct {
+		Advance time.Duration
+		Wait    time.Duration
+		OK      bool
+	}
+
+	steps := []step{
+		{OK: true},
+		{OK: true},
+		{Wait: 100 * time.Millisecond, OK: true},
+		// the next token is 200ms away, longer than MaxWait
+		{OK: false},
+		{Advance: 100 * time.Millisecond, Wait: 100 * time.Millisecond, OK: true},
+		{Advance: time.Second, OK: true},
+		{OK: true},
+		{Wait: 100 * time.Millisecond, OK: true},
+	}
+
+	for i, step := range steps {
+		now = now.Add(step.Advance)
+		wait, ok := l.reserve()
+		if g, e := ok, step.OK; g != e {
+			t.Fatalf("step %d: should %v but got %v", i, e, g)
+		}
+		if g, e := wait.Round(time.Millisecond), step.Wait; g != e {
+			t.Errorf("step %d: should wait %v but got %v", i, e, g)
+		}
+	}
+}
+
+func TestRateLimiterWaitCancel(t *testing.T) {
+	l := NewRateLimiter(1, 1, time.Hour)
+	if ok, err := l.Wait(context.Background()); !ok || err != nil {
+		t.Fatalf("should get token but got %v %v", ok, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if ok, err := l.Wait(ctx); ok || err != context.DeadlineExceeded {
+		t.Errorf("should %v but got %v %v", context.DeadlineExceeded, ok, err)
+	}
+}
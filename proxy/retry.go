@@ -0,0 +1,163 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+// RetryPolicy decides whether a failed request to a target is sent again.
+type RetryPolicy struct {
+	// MaxAttempts includes the first attempt.
+	MaxAttempts int
+	// StatusCodes and ErrorKinds are retried. Both empty means
+	// DefaultRetryStatusCodes and DefaultRetryErrorKinds.
+	StatusCodes []int
+	ErrorKinds  []ErrorKind
+	// the delay before attempt n+1 is random between zero and
+	// BaseDelay * 2^(n-1), capped at MaxDelay.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// NonIdempotent allows retrying methods such as POST.
+	NonIdempotent bool
+}
+
+const (
+	DefaultRetryBaseDelay = 100 * time.Millisecond
+	DefaultRetryMaxDelay  = 2 * time.Second
+)
+
+var (
+	DefaultRetryStatusCodes = []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout}
+	DefaultRetryErrorKinds  = []ErrorKind{ErrorKindConnectRefused, ErrorKindConnectReset}
+)
+
+func isIdempotent(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+		return true
+	}
+	return false
+}
+
+func (r *RetryPolicy) retryable(req *http.Request, res *http.Response, err error) bool {
+	if !r.NonIdempotent && !isIdempotent(req.Method) {
+		return false
+	}
+
+	statusCodes, errorKinds := r.StatusCodes, r.ErrorKinds
+	if len(statusCodes) == 0 && len(errorKinds) == 0 {
+		statusCodes, errorKinds = DefaultRetryStatusCodes, DefaultRetryErrorKinds
+	}
+
+	if err != nil {
+		kind := classifyError(err)
+		for _, k := range errorKinds {
+			if k == kind {
+				return true
+			}
+		}
+		return false
+	}
+	for _, code := range statusCodes {
+		if code == res.StatusCode {
+			return true
+		}
+	}
+	return false
+}
+
+// backoff returns the delay after attempt, with full jitter.
+func (r *RetryPolicy) backoff(attempt int) time.Duration {
+	base, max := r.BaseDelay, r.MaxDelay
+	if base <= 0 {
+		base = DefaultRetryBaseDelay
+	}
+	if max <= 0 {
+		max = DefaultRetryMaxDelay
+	}
+
+	d := base
+	for i := 1; i < attempt && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return time.Duration(rand.Int63n(int64(d) + 1))
+}
+
+// roundTrip sends req to the target, retrying as its RetryPolicy allows.
+// A retry is not started when its delay would run past the deadline of
+// req; the last result is returned instead. Every attempt is recorded to
+// metrics when it is not nil.
+func (p *Proxy) roundTrip(target *Target, req *http.Request, item *JsonItem, metrics *Metrics) (*http.Response, error) {
+	policy := target.Retry
+	for attempt := 1; ; attempt++ {
+		if policy != nil {
+			item.Attempts = attempt
+		}
+
+		outreq := req
+		if attempt > 1 {
+			outreq = req.Clone(req.Context())
+			if req.GetBody != nil {
+				body, err := req.GetBody()
+				if err != nil {
+					return nil, err
+				}
+				outreq.Body = body
+			}
+		}
+
+		start := time.Now()
+		res, err := p.Transport.RoundTrip(outreq)
+		if metrics != nil {
+			metrics.observeRoundTrip(target, res, err, time.Since(start))
+		}
+		if target.Breaker != nil {
+			target.Breaker.doneRoundTrip(res, err)
+		}
+		if policy == nil || attempt >= policy.MaxAttempts || !policy.retryable(req, res, err) {
+			return res, err
+		}
+
+		delay := policy.backoff(attempt)
+		if deadline, ok := req.Context().Deadline(); ok && time.Until(deadline) <= delay {
+			return res, err
+		}
+		if target.Breaker != nil && !target.Breaker.Allow() {
+			return res, err
+		}
+		if res != nil {
+			io.Copy(ioutil.Discard, res.Body)
+			res.Body.Close()
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			if target.Breaker != nil {
+				target.Breaker.Abort()
+			}
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+
+		if target.RateLimit != nil {
+			if ok, err := target.RateLimit.Wait(req.Context()); !ok {
+				if target.Breaker != nil {
+					target.Breaker.Abort()
+				}
+				if err != nil {
+					return nil, err
+				}
+				return nil, &TargetError{Kind: ErrorKindRateLimited, Err: errors.New("rate limit exceeded")}
+			}
+		}
+	}
+}
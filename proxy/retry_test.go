@@ -0,0 +1,59 @@
+package proxy
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicyRetryable(t *testing.T) {
+	refused := os.NewSyscallError("connect", syscall.ECONNREFUSED)
+
+	type spec struct {
+		Policy     RetryPolicy
+		Method     string
+		StatusCode int
+		Err        error
+		Expected   bool
+	}
+
+	specs := []spec{
+		{Policy: RetryPolicy{}, Method: "GET", StatusCode: 503, Expected: true},
+		{Policy: RetryPolicy{}, Method: "GET", StatusCode: 500, Expected: false},
+		{Policy: RetryPolicy{}, Method: "GET", Err: refused, Expected: true},
+		{Policy: RetryPolicy{}, Method: "GET", Err: errors.New("something"), Expected: false},
+		{Policy: RetryPolicy{}, Method: "POST", StatusCode: 503, Expected: false},
+		{Policy: RetryPolicy{NonIdempotent: true}, Method: "POST", StatusCode: 503, Expected: true},
+		{Policy: RetryPolicy{StatusCodes: []int{500}}, Method: "GET", StatusCode: 500, Expected: true},
+		{Policy: RetryPolicy{StatusCodes: []int{500}}, Method: "GET", Err: refused, Expected: false},
+		{Policy: RetryPolicy{ErrorKinds: []ErrorKind{ErrorKindUnknown}}, Method: "PUT", Err: errors.New("something"), Expected: true},
+	}
+
+	for i, spec := range specs {
+		req := httptest.NewRequest(spec.Method, "/", nil)
+		var res *http.Response
+		if spec.Err == nil {
+			res = &http.Response{StatusCode: spec.StatusCode}
+		}
+		if g, e := spec.Policy.retryable(req, res, spec.Err), spec.Expected; g != e {
+			t.Errorf("spec %d: should %v but got %v", i, e, g)
+		}
+	}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	policy := &RetryPolicy{BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second}
+	limits := []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond, time.Second, time.Second}
+
+	for i, limit := range limits {
+		for n := 0; n < 100; n++ {
+			if d := policy.backoff(i + 1); d < 0 || d > limit {
+				t.Fatalf("attempt %d: should be between 0 and %v but got %v", i+1, limit, d)
+			}
+		}
+	}
+}
@@ -9,10 +9,14 @@
 package proxy
 
 import (
+	"encoding/json"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"reflect"
+	"regexp"
 	"strings"
+	"sync"
 	"testing"
 )
 
@@ -109,6 +113,8 @@ var proxyQueryTests = []struct {
 	{"?sta=tic", "?us=er", "sta=tic&us=er"},
 	{"", "?us=er", "us=er"},
 	{"?sta=tic", "", "sta=tic"},
+	{"", "?us=er&_timing=1", "us=er"},
+	{"?sta=tic", "?_timing&us=er", "sta=tic&us=er"},
 }
 
 func TestReverseProxyQuery(t *testing.T) {
@@ -139,3 +145,132 @@ func TestReverseProxyQuery(t *testing.T) {
 		frontend.Close()
 	}
 }
+
+func TestTargetHeaders(t *testing.T) {
+	var mu sync.Mutex
+	seen := map[string]bool{}
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		seen[r.Header.Get("X-Target")] = true
+		mu.Unlock()
+		if g, e := r.Header.Get("Authorization"), "Bearer "+r.Header.Get("X-Target"); g != e {
+			t.Errorf("got Authorization %q, want %q", g, e)
+		}
+		if g := r.Header.Get("Cookie"); g != "" {
+			t.Errorf("got Cookie %q, want empty", g)
+		}
+		if g, e := r.Header["X-Tag"], []string{"client", "collector"}; !reflect.DeepEqual(g, e) {
+			t.Errorf("got X-Tag %q, want %q", g, e)
+		}
+		if g, e := r.Host, r.Header.Get("X-Target")+".internal"; g != e {
+			t.Errorf("got Host %q, want %q", g, e)
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer backend.Close()
+	backendURL, err := url.Parse(backend.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	targets := []*Target{}
+	for _, name := range []string{"a", "b"} {
+		targets = append(targets, &Target{
+			URL:           backendURL,
+			RemoveHeaders: []string{"cookie"},
+			SetHeaders: http.Header{
+				"Authorization": {"Bearer " + name},
+				"X-Target":      {name},
+				"Host":          {name + ".internal"},
+			},
+			AddHeaders: http.Header{"X-Tag": {"collector"}},
+		})
+	}
+	proxy := NewProxyWithTargets(targets)
+	frontend := httptest.NewServer(proxy)
+	defer frontend.Close()
+
+	getReq, _ := http.NewRequest("GET", frontend.URL, nil)
+	getReq.Header.Set("Authorization", "Bearer client")
+	getReq.Header.Set("Cookie", "session=secret")
+	getReq.Header.Set("X-Tag", "client")
+	res, err := http.DefaultClient.Do(getReq)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	defer res.Body.Close()
+
+	var jsonItems []JsonItem
+	if err := json.NewDecoder(res.Body).Decode(&jsonItems); err != nil {
+		t.Fatal(err)
+	}
+	if g, e := len(jsonItems), 2; g != e {
+		t.Fatalf("should %v but got %v", e, g)
+	}
+	for _, item := range jsonItems {
+		if item.Error != nil {
+			t.Errorf("should no error but got %v", item.Error)
+		}
+		if g, e := item.StatusCode, http.StatusOK; g != e {
+			t.Errorf("should %v but got %v", e, g)
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if g, e := seen, map[string]bool{"a": true, "b": true}; !reflect.DeepEqual(g, e) {
+		t.Errorf("should %v but got %v", e, g)
+	}
+}
+
+var proxyRewriteTests = []struct {
+	baseSuffix string   // suffix to add to backend URL
+	rewrite    *Rewrite // rewrite of the target
+	reqSuffix  string   // suffix to add to frontend's request URL
+	wantPath   string   // what backend should see for final request path
+	wantQuery  string   // what backend should see for final request URL (without ?)
+}{
+	{"", nil, "/api/foo", "/api/foo", ""},
+	{"", &Rewrite{StripPrefix: "/api"}, "/api/foo", "/foo", ""},
+	{"", &Rewrite{StripPrefix: "/api"}, "/apiary", "/apiary", ""},
+	{"", &Rewrite{StripPrefix: "/api"}, "/api", "/", ""},
+	{"", &Rewrite{StripPrefix: "/api", AddPrefix: "/v2"}, "/api/foo?us=er", "/v2/foo", "us=er"},
+	{"/base", &Rewrite{StripPrefix: "/api/"}, "/api/foo", "/base/foo", ""},
+	{"", &Rewrite{StripPrefix: "/other"}, "/api/foo", "/api/foo", ""},
+	{"", &Rewrite{Regexp: regexp.MustCompile(`^/api/(\w+)$`), Replacement: "/v2/$1/index"}, "/api/foo", "/v2/foo/index", ""},
+	{"", &Rewrite{AddPrefix: "/v1/"}, "/foo", "/v1/foo", ""},
+	{"?sta=tic", &Rewrite{RemoveQuery: []string{"debug"}}, "/?us=er&debug=1", "/", "sta=tic&us=er"},
+	{"", &Rewrite{AddQuery: url.Values{"version": {"2"}}}, "/?us=er", "/", "us=er&version=2"},
+	{"", &Rewrite{RemoveQuery: []string{"us"}, AddQuery: url.Values{"us": {"collector"}}}, "/?us=er", "/", "us=collector"},
+}
+
+func TestReverseProxyRewrite(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if g, e := r.URL.Path, r.Header.Get("X-Want-Path"); g != e {
+			t.Errorf("got r.URL.Path %v. but expected %v", g, e)
+		}
+		if g, e := r.URL.RawQuery, r.Header.Get("X-Want-Query"); g != e {
+			t.Errorf("got r.URL.RawQuery %v. but expected %v", g, e)
+		}
+		w.Write([]byte("hi"))
+	}))
+	defer backend.Close()
+
+	for i, tt := range proxyRewriteTests {
+		backendURL, err := url.Parse(backend.URL + tt.baseSuffix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		proxy := NewProxyWithTargets([]*Target{{URL: backendURL, Rewrite: tt.rewrite}})
+		frontend := httptest.NewServer(proxy)
+		req, _ := http.NewRequest("GET", frontend.URL+tt.reqSuffix, nil)
+		req.Header.Set("X-Want-Path", tt.wantPath)
+		req.Header.Set("X-Want-Query", tt.wantQuery)
+		req.Close = true
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%d. Get: %v", i, err)
+		}
+		res.Body.Close()
+		frontend.Close()
+	}
+}
@@ -0,0 +1,58 @@
+package proxy
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// Rewrite changes the request path and query for one target. The path
+// rules are applied to the inbound request path, in the order StripPrefix,
+// Regexp and AddPrefix, before it is joined with the target path. The
+// query rules are applied to the final query, RemoveQuery first.
+type Rewrite struct {
+	StripPrefix string
+	// Regexp is replaced with Replacement, which may refer to groups as $1.
+	Regexp      *regexp.Regexp
+	Replacement string
+	AddPrefix   string
+
+	RemoveQuery []string
+	AddQuery    url.Values
+}
+
+func (r *Rewrite) rewritePath(p string) string {
+	if r.StripPrefix != "" && hasPathPrefix(p, r.StripPrefix) {
+		p = p[len(r.StripPrefix):]
+		if !strings.HasPrefix(p, "/") {
+			p = "/" + p
+		}
+	}
+	if r.Regexp != nil {
+		p = r.Regexp.ReplaceAllString(p, r.Replacement)
+	}
+	if r.AddPrefix != "" {
+		p = singleJoiningSlash(r.AddPrefix, p)
+	}
+	return p
+}
+
+func (r *Rewrite) rewriteQuery(rawQuery string) string {
+	if len(r.RemoveQuery) == 0 && len(r.AddQuery) == 0 {
+		return rawQuery
+	}
+
+	q, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return rawQuery
+	}
+	for _, key := range r.RemoveQuery {
+		q.Del(key)
+	}
+	for key, values := range r.AddQuery {
+		for _, v := range values {
+			q.Add(key, v)
+		}
+	}
+	return q.Encode()
+}
@@ -0,0 +1,71 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Route sends requests whose path matches Prefix or Pattern to its own
+// Proxy, which has its own target list and settings.
+type Route struct {
+	Name    string
+	Prefix  string
+	Pattern *regexp.Regexp
+	Proxy   *Proxy
+}
+
+// Match reports whether path is for the route. Prefix matches whole path
+// segments, so that "/api" matches "/api" and "/api/users" but not
+// "/apiary".
+func (r *Route) Match(path string) bool {
+	if r.Pattern != nil {
+		return r.Pattern.MatchString(path)
+	}
+	return hasPathPrefix(path, r.Prefix)
+}
+
+// hasPathPrefix reports whether prefix is whole segments at the start of
+// path: the rest is empty or starts with "/", or prefix ends with "/".
+func hasPathPrefix(path, prefix string) bool {
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+	return len(path) == len(prefix) || strings.HasSuffix(prefix, "/") || path[len(prefix)] == '/'
+}
+
+// matchRoute returns the first route matching path, or nil.
+func matchRoute(routes []*Route, path string) *Route {
+	for _, r := range routes {
+		if r.Match(path) {
+			return r
+		}
+	}
+	return nil
+}
+
+func writeJSONError(rw http.ResponseWriter, statusCode int, jsonErr *JsonError) {
+	b, err := json.Marshal(struct {
+		Error *JsonError `json:"error"`
+	}{jsonErr})
+	if err != nil {
+		log.Errorf("json encode err:%v", err)
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(statusCode)
+	rw.Write(append(b, '\n'))
+}
+
+func writeNoRoute(rw http.ResponseWriter, req *http.Request) {
+	writeJSONError(rw, http.StatusNotFound, &JsonError{
+		Message: fmt.Sprintf("no route for path:%v", req.URL.Path),
+		Kind:    ErrorKindNoRoute,
+	})
+}
@@ -0,0 +1,81 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// JsonStatus is the state of every target, including the targets of
+// routes.
+type JsonStatus struct {
+	Targets []*JsonTargetStatus `json:"targets"`
+}
+
+type JsonTargetStatus struct {
+	// Route is the name of the route, or its index when unnamed.
+	Route  string `json:"route,omitempty"`
+	Index  int    `json:"index"`
+	Target string `json:"target"`
+	Name   string `json:"name,omitempty"`
+	// Healthy is set when a health checker runs.
+	Healthy *bool `json:"healthy,omitempty"`
+	// Circuit is set when the target has a circuit breaker.
+	Circuit  BreakerState `json:"circuit,omitempty"`
+	Draining bool         `json:"draining,omitempty"`
+}
+
+func (p *Proxy) Status() *JsonStatus {
+	s := &JsonStatus{Targets: []*JsonTargetStatus{}}
+	p.appendStatus(s, "")
+	return s
+}
+
+func (p *Proxy) appendStatus(s *JsonStatus, route string) {
+	p.m.RLock()
+	defer p.m.RUnlock()
+
+	for i, t := range p.TargetList {
+		ts := &JsonTargetStatus{
+			Route:    route,
+			Index:    i,
+			Target:   t.String(),
+			Name:     t.Name,
+			Draining: t.draining,
+		}
+		if p.HealthChecker != nil {
+			healthy := p.HealthChecker.Healthy(t)
+			ts.Healthy = &healthy
+		}
+		if t.Breaker != nil {
+			ts.Circuit = t.Breaker.State()
+		}
+		s.Targets = append(s.Targets, ts)
+	}
+	for i, r := range p.Routes {
+		name := r.Name
+		if name == "" {
+			name = strconv.Itoa(i)
+		}
+		r.Proxy.appendStatus(s, name)
+	}
+}
+
+// StatusHandler writes the status of p as JSON.
+func StatusHandler(p *Proxy) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		var b bytes.Buffer
+		if err := json.NewEncoder(&b).Encode(p.Status()); err != nil {
+			log.Errorf("json encode err:%v", err)
+			rw.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		rw.Header().Set("Content-Type", "application/json")
+		rw.WriteHeader(http.StatusOK)
+		rw.Write(b.Bytes())
+	})
+}
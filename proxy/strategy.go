@@ -0,0 +1,179 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type StrategyKind string
+
+const (
+	// StrategyAll waits for every target.
+	StrategyAll StrategyKind = "all"
+	// StrategyFirst returns as soon as one target answers 2xx.
+	StrategyFirst StrategyKind = "first"
+	// StrategyQuorum returns once N targets answer 2xx with the same body.
+	StrategyQuorum StrategyKind = "quorum"
+	// StrategyAnyN returns once N targets answer, whatever the status code.
+	StrategyAnyN StrategyKind = "any_n"
+)
+
+// Strategy decides when enough targets have answered. Targets still
+// running at that point are cancelled and reported as canceled.
+type Strategy struct {
+	Kind StrategyKind
+	N    int
+}
+
+// ParseStrategy parses "all", "first", "quorum:N" or "any_n:N".
+func ParseStrategy(s string) (Strategy, error) {
+	kind, arg := s, ""
+	if i := strings.Index(s, ":"); i >= 0 {
+		kind, arg = s[:i], s[i+1:]
+	}
+
+	switch StrategyKind(kind) {
+	case "", StrategyAll, StrategyFirst:
+		if arg != "" {
+			return Strategy{}, fmt.Errorf("strategy %v does not take argument:%v", kind, s)
+		}
+		if kind == "" {
+			return Strategy{Kind: StrategyAll}, nil
+		}
+		return Strategy{Kind: StrategyKind(kind)}, nil
+	case StrategyQuorum, StrategyAnyN:
+		n, err := strconv.Atoi(arg)
+		if err != nil || n <= 0 {
+			return Strategy{}, fmt.Errorf("strategy %v needs positive number:%v", kind, s)
+		}
+		return Strategy{Kind: StrategyKind(kind), N: n}, nil
+	default:
+		return Strategy{}, fmt.Errorf("not support strategy:%v", s)
+	}
+}
+
+func (s Strategy) String() string {
+	switch s.Kind {
+	case StrategyQuorum, StrategyAnyN:
+		return fmt.Sprintf("%v:%d", s.Kind, s.N)
+	case "":
+		return string(StrategyAll)
+	default:
+		return string(s.Kind)
+	}
+}
+
+// strategyState counts the items seen so far.
+type strategyState struct {
+	strategy Strategy
+	answered int
+	groups   map[string]int
+}
+
+// add records item and reports whether the strategy is satisfied.
+func (st *strategyState) add(item *JsonItem) bool {
+	switch st.strategy.Kind {
+	case StrategyFirst:
+		return item.Error == nil && is2xx(item.StatusCode)
+	case StrategyAnyN:
+		if item.Error == nil {
+			st.answered++
+		}
+		return st.answered >= st.strategy.N
+	case StrategyQuorum:
+		if item.Error != nil || !is2xx(item.StatusCode) {
+			return false
+		}
+		if st.groups == nil {
+			st.groups = map[string]int{}
+		}
+		key := canonicalKey(item)
+		st.groups[key]++
+		return st.groups[key] >= st.strategy.N
+	default:
+		return false
+	}
+}
+
+// applyStrategy forwards items from itemChan until strategy is satisfied.
+// Then it forwards the items already waiting in itemChan, cancels the
+// remaining requests and emits a canceled item for every target which
+// has not answered yet.
+func applyStrategy(itemChan <-chan *JsonItem, targetReqs []*targetRequest, strategy Strategy, cancel context.CancelFunc) <-chan *JsonItem {
+	if strategy.Kind == StrategyAll || strategy.Kind == "" {
+		return itemChan
+	}
+
+	outChan := make(chan *JsonItem, len(targetReqs))
+	go func() {
+		defer close(outChan)
+
+		st := &strategyState{strategy: strategy}
+		seen := make(map[int]bool, len(targetReqs))
+		for item := range itemChan {
+			seen[item.Index] = true
+			outChan <- item
+			if !st.add(item) {
+				continue
+			}
+
+			// items already done are real answers, not cancellations
+		drain:
+			for {
+				select {
+				case item, ok := <-itemChan:
+					if !ok {
+						break drain
+					}
+					seen[item.Index] = true
+					outChan <- item
+				default:
+					break drain
+				}
+			}
+
+			cancel()
+			for _, treq := range targetReqs {
+				if seen[treq.index] {
+					continue
+				}
+				item := treq.newItem()
+				item.Error = &JsonError{
+					Message: fmt.Sprintf("cancelled by strategy %v", strategy),
+					Kind:    ErrorKindCanceled,
+				}
+				outChan <- item
+			}
+			return
+		}
+	}()
+	return outChan
+}
+
+func is2xx(statusCode int) bool {
+	return statusCode >= 200 && statusCode < 300
+}
+
+// canonicalKey identifies status code and body regardless of JSON
+// formatting and object key order.
+func canonicalKey(item *JsonItem) string {
+	return strconv.Itoa(item.StatusCode) + ":" + string(canonicalBody(item.Body))
+}
+
+func canonicalBody(body json.RawMessage) []byte {
+	var v interface{}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	if err := dec.Decode(&v); err != nil {
+		return bytes.TrimSpace(body)
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return bytes.TrimSpace(body)
+	}
+	return b
+}
@@ -0,0 +1,74 @@
+package proxy
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestParseStrategy(t *testing.T) {
+	specs := []struct {
+		Input    string
+		Expected Strategy
+		Error    string
+	}{
+		{Input: "", Expected: Strategy{Kind: StrategyAll}},
+		{Input: "all", Expected: Strategy{Kind: StrategyAll}},
+		{Input: "first", Expected: Strategy{Kind: StrategyFirst}},
+		{Input: "quorum:2", Expected: Strategy{Kind: StrategyQuorum, N: 2}},
+		{Input: "any_n:3", Expected: Strategy{Kind: StrategyAnyN, N: 3}},
+		{Input: "first:1", Error: "strategy first does not take argument:first:1"},
+		{Input: "quorum", Error: "strategy quorum needs positive number:quorum"},
+		{Input: "any_n:0", Error: "strategy any_n needs positive number:any_n:0"},
+		{Input: "fastest", Error: "not support strategy:fastest"},
+	}
+
+	for _, spec := range specs {
+		got, err := ParseStrategy(spec.Input)
+		if err != nil {
+			if g, e := err.Error(), spec.Error; g != e {
+				t.Errorf("%v: should %v but got %v", spec.Input, e, g)
+			}
+			continue
+		}
+		if spec.Error != "" {
+			t.Errorf("%v: should %v but got nil", spec.Input, spec.Error)
+		}
+		if got != spec.Expected {
+			t.Errorf("%v: should %v but got %v", spec.Input, spec.Expected, got)
+		}
+	}
+}
+
+func TestApplyStrategyDrainsDoneItems(t *testing.T) {
+	var targetReqs []*targetRequest
+	for i, host := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"} {
+		targetReqs = append(targetReqs, &targetRequest{index: i, target: &Target{URL: &url.URL{Scheme: "http", Host: host}}})
+	}
+
+	// the first two targets are done before the strategy looks at them
+	itemChan := make(chan *JsonItem, len(targetReqs))
+	itemChan <- &JsonItem{Index: 0, StatusCode: 200}
+	itemChan <- &JsonItem{Index: 1, StatusCode: 200}
+
+	canceled := false
+	outChan := applyStrategy(itemChan, targetReqs, Strategy{Kind: StrategyFirst}, func() { canceled = true })
+
+	var items []*JsonItem
+	for item := range outChan {
+		items = append(items, item)
+	}
+	if !canceled {
+		t.Errorf("remaining requests should be canceled")
+	}
+	if g, e := len(items), 3; g != e {
+		t.Fatalf("should %v but got %v", e, g)
+	}
+	for i, item := range items[:2] {
+		if item.Error != nil || item.StatusCode != 200 {
+			t.Errorf("item %d: should be answer but got %+v", i, item.Error)
+		}
+	}
+	if items[2].Index != 2 || items[2].Error == nil || items[2].Error.Kind != ErrorKindCanceled {
+		t.Errorf("should be canceled but got %+v", items[2])
+	}
+}
@@ -0,0 +1,103 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// Target is one backend of the fan-out.
+type Target struct {
+	// Name and Labels are copied to JsonItem. Both are optional.
+	Name   string
+	URL    *url.URL
+	Labels map[string]string
+
+	// RemoveHeaders, SetHeaders and AddHeaders are applied in this order
+	// to the request sent to the target. "Host" overrides the host.
+	RemoveHeaders []string
+	SetHeaders    http.Header
+	AddHeaders    http.Header
+
+	// Rewrite changes path and query sent to the target. It is optional.
+	Rewrite *Rewrite
+
+	// Breaker fails requests fast while the target keeps failing. It is
+	// optional.
+	Breaker *CircuitBreaker
+
+	// Retry sends failed requests again. It is optional.
+	Retry *RetryPolicy
+
+	// RateLimit bounds the requests sent to the target, retries
+	// included. It is optional.
+	RateLimit *RateLimiter
+
+	// draining targets get no new requests. It is guarded by Proxy.m.
+	draining bool
+}
+
+// NewTargets wraps each url as an unnamed Target.
+func NewTargets(urls []*url.URL) []*Target {
+	targets := make([]*Target, 0, len(urls))
+	for _, u := range urls {
+		targets = append(targets, &Target{URL: u})
+	}
+	return targets
+}
+
+// ParseTargetURL parses the url of a target, which must be absolute http
+// or https with host. url.Parse alone accepts typos such as
+// localhost:5000 without scheme.
+func ParseTargetURL(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid url:%v", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("url scheme must be http or https:%v", s)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("url has no host:%v", s)
+	}
+	return u, nil
+}
+
+func (t *Target) String() string {
+	return t.URL.String()
+}
+
+// applyHeaders modifies the headers of outreq, which must be a request
+// cloned for this target. The header map is copied before modification
+// since it is shared with the inbound request.
+func (t *Target) applyHeaders(outreq *http.Request) {
+	if len(t.RemoveHeaders) == 0 && len(t.SetHeaders) == 0 && len(t.AddHeaders) == 0 {
+		return
+	}
+
+	header := make(http.Header, len(outreq.Header))
+	copyHeader(header, outreq.Header)
+	outreq.Header = header
+
+	for _, name := range t.RemoveHeaders {
+		if http.CanonicalHeaderKey(name) == "Host" {
+			outreq.Host = ""
+			continue
+		}
+		header.Del(name)
+	}
+	for name, values := range t.SetHeaders {
+		if http.CanonicalHeaderKey(name) == "Host" {
+			if len(values) > 0 {
+				outreq.Host = values[0]
+			}
+			continue
+		}
+		header[http.CanonicalHeaderKey(name)] = append([]string(nil), values...)
+	}
+	for name, values := range t.AddHeaders {
+		for _, v := range values {
+			header.Add(name, v)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// JsonTiming is the time spent on each phase of a target request, in milliseconds.
+type JsonTiming struct {
+	Total        float64 `json:"total_ms"`
+	DNS          float64 `json:"dns_ms,omitempty"`
+	Connect      float64 `json:"connect_ms,omitempty"`
+	TLSHandshake float64 `json:"tls_handshake_ms,omitempty"`
+	FirstByte    float64 `json:"first_byte_ms,omitempty"`
+}
+
+type timingRecorder struct {
+	m         sync.Mutex
+	start     time.Time
+	dnsStart  time.Time
+	dns       time.Duration
+	connStart time.Time
+	connect   time.Duration
+	tlsStart  time.Time
+	tls       time.Duration
+	firstByte time.Duration
+}
+
+func newTimingRecorder() *timingRecorder {
+	return &timingRecorder{start: time.Now()}
+}
+
+// withTrace returns req that reports connection events to the recorder.
+func (r *timingRecorder) withTrace(req *http.Request) *http.Request {
+	trace := &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			r.m.Lock()
+			r.dnsStart = time.Now()
+			r.m.Unlock()
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			r.m.Lock()
+			r.dns = time.Since(r.dnsStart)
+			r.m.Unlock()
+		},
+		ConnectStart: func(network, addr string) {
+			r.m.Lock()
+			if r.connStart.IsZero() {
+				r.connStart = time.Now()
+			}
+			r.m.Unlock()
+		},
+		ConnectDone: func(network, addr string, err error) {
+			r.m.Lock()
+			if err == nil {
+				r.connect = time.Since(r.connStart)
+			}
+			r.m.Unlock()
+		},
+		TLSHandshakeStart: func() {
+			r.m.Lock()
+			r.tlsStart = time.Now()
+			r.m.Unlock()
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			r.m.Lock()
+			r.tls = time.Since(r.tlsStart)
+			r.m.Unlock()
+		},
+		GotFirstResponseByte: func() {
+			r.m.Lock()
+			r.firstByte = time.Since(r.start)
+			r.m.Unlock()
+		},
+	}
+	return req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+}
+
+// finish returns the timing with total measured up to now.
+func (r *timingRecorder) finish() *JsonTiming {
+	total := time.Since(r.start)
+
+	r.m.Lock()
+	defer r.m.Unlock()
+	return &JsonTiming{
+		Total:        milliseconds(total),
+		DNS:          milliseconds(r.dns),
+		Connect:      milliseconds(r.connect),
+		TLSHandshake: milliseconds(r.tls),
+		FirstByte:    milliseconds(r.firstByte),
+	}
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}